@@ -2,8 +2,10 @@ package log_v1
 
 import (
 	"fmt"
+	"strconv"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	status "google.golang.org/grpc/status"
 )
 
@@ -32,3 +34,229 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrStaleSequence is returned when a producer sends a sequence number older
+// than the last one the log appended for it, so the original offset is no
+// longer known. Producers find the last sequence in the ErrorInfo details'
+// "last" metadata.
+type ErrStaleSequence struct {
+	ProducerID string
+	Sequence   uint64
+	Last       uint64
+}
+
+func (e ErrStaleSequence) GRPCStatus() *status.Status {
+	st := status.New(codes.AlreadyExists, fmt.Sprintf(
+		"stale sequence for producer %q: %d", e.ProducerID, e.Sequence),
+	)
+	msg := fmt.Sprintf(
+		"The producer %q already appended sequence %d, last sequence is %d",
+		e.ProducerID, e.Sequence, e.Last,
+	)
+	std, err := st.WithDetails(
+		&errdetails.LocalizedMessage{
+			Locale:  "en-US",
+			Message: msg,
+		},
+		&errdetails.ErrorInfo{
+			Reason: "STALE_SEQUENCE",
+			Domain: "proglog",
+			Metadata: map[string]string{
+				"producer_id": e.ProducerID,
+				"last":        strconv.FormatUint(e.Last, 10),
+			},
+		},
+	)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrStaleSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTransactionNotOpen is returned when appending to, committing or aborting
+// a transaction that was never begun or has already ended.
+type ErrTransactionNotOpen struct {
+	TransactionID uint64
+}
+
+func (e ErrTransactionNotOpen) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf(
+		"transaction not open: %d", e.TransactionID),
+	)
+	msg := fmt.Sprintf(
+		"The transaction %d was never begun or has already ended",
+		e.TransactionID,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrTransactionNotOpen) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrOffsetConflict is returned by a conditional append when the log's next
+// offset isn't the one the caller expected.
+type ErrOffsetConflict struct {
+	Expected uint64
+	Next     uint64
+}
+
+func (e ErrOffsetConflict) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf(
+		"offset conflict: expected %d, next %d", e.Expected, e.Next),
+	)
+	msg := fmt.Sprintf(
+		"The log's next offset is %d, not the expected %d",
+		e.Next, e.Expected,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOffsetConflict) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrGroupOffsetNotFound is returned when fetching the offset of a consumer
+// group that hasn't committed one.
+type ErrGroupOffsetNotFound struct {
+	Group     string
+	Partition uint32
+}
+
+func (e ErrGroupOffsetNotFound) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, fmt.Sprintf(
+		"no committed offset for group: %q partition: %d",
+		e.Group, e.Partition),
+	)
+	msg := fmt.Sprintf(
+		"The consumer group %q hasn't committed an offset for partition %d",
+		e.Group, e.Partition,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrGroupOffsetNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrFencedMember is returned when a consumer group member that left, timed
+// out or missed a rebalance acts on the group.
+type ErrFencedMember struct {
+	Group      string
+	MemberID   string
+	Generation uint64
+}
+
+func (e ErrFencedMember) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf(
+		"fenced member %q of group %q: generation %d",
+		e.MemberID, e.Group, e.Generation),
+	)
+	msg := fmt.Sprintf(
+		"The member %q isn't part of generation %d of group %q, rejoin the group",
+		e.MemberID, e.Generation, e.Group,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrFencedMember) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNotPrimary is returned when a secondary server that doesn't forward
+// writes receives one. Clients find the primary's address in the ErrorInfo
+// details' "primary" metadata.
+type ErrNotPrimary struct {
+	Primary string
+}
+
+func (e ErrNotPrimary) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf(
+		"not the primary, write to %s", e.Primary),
+	)
+	msg := fmt.Sprintf(
+		"This server doesn't accept writes, send them to the primary at %s",
+		e.Primary,
+	)
+	std, err := st.WithDetails(
+		&errdetails.LocalizedMessage{
+			Locale:  "en-US",
+			Message: msg,
+		},
+		&errdetails.ErrorInfo{
+			Reason:   "NOT_PRIMARY",
+			Domain:   "proglog",
+			Metadata: map[string]string{"primary": e.Primary},
+		},
+	)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotPrimary) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrShuttingDown ends the streams of a server that's shutting down and fails
+// the RPCs it receives meanwhile; clients retry them on another server.
+type ErrShuttingDown struct{}
+
+func (e ErrShuttingDown) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, "the server is shutting down")
+	std, err := st.WithDetails(
+		&errdetails.LocalizedMessage{
+			Locale:  "en-US",
+			Message: "The server is shutting down, retry on another server",
+		},
+		&errdetails.ErrorInfo{
+			Reason: "SHUTTING_DOWN",
+			Domain: "proglog",
+		},
+	)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrShuttingDown) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+	"github.com/Franklynoble/proglog/internal/config"
+	"github.com/Franklynoble/proglog/internal/mirror"
+)
+
+/*
+proglog-mirror continuously copies the records of a source server, say in one
+region's cluster, to a destination server in another's. It checkpoints the
+source offsets it mirrored to a file and resumes from it when restarted, and
+it can limit the mirror to some topics and rename topics on the way. It runs
+until it's interrupted or terminated.
+
+	proglog-mirror [flags] -source addr -destination addr -checkpoint file
+*/
+func main() {
+	source := flag.String("source", "", "address of the server to mirror")
+	destination := flag.String("destination", "", "address of the server to mirror to")
+	checkpoint := flag.String("checkpoint", "", "file keeping the mirrored source offsets")
+	startOffset := flag.Uint64("start-offset", 0, "source offset to start at without a checkpoint")
+	topics := flag.String("topics", "", "comma-separated topics to mirror, all if empty")
+	renames := flag.String("renames", "", "comma-separated source=destination topic renames")
+	producerID := flag.String("producer-id", "proglog-mirror", "producer ID to append to the destination as")
+	sourceCA := flag.String("source-ca", config.CAFile, "CA certificate file of the source")
+	sourceCert := flag.String("source-cert", config.RootClientCertFile, "client certificate file for the source")
+	sourceKey := flag.String("source-key", config.RootClientKeyFile, "client key file for the source")
+	destinationCA := flag.String("destination-ca", config.CAFile, "CA certificate file of the destination")
+	destinationCert := flag.String("destination-cert", config.RootClientCertFile, "client certificate file for the destination")
+	destinationKey := flag.String("destination-key", config.RootClientKeyFile, "client key file for the destination")
+	flag.Parse()
+	if *source == "" || *destination == "" || *checkpoint == "" || flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := mirror.Config{
+		CheckpointFile: *checkpoint,
+		StartOffset:    *startOffset,
+		ProducerID:     *producerID,
+	}
+	if *topics != "" {
+		c.Topics = strings.Split(*topics, ",")
+	}
+	if *renames != "" {
+		c.Renames = make(map[string]string)
+		for _, rename := range strings.Split(*renames, ",") {
+			parts := strings.SplitN(rename, "=", 2)
+			if len(parts) != 2 {
+				log.Fatalf("invalid rename %q, want source=destination", rename)
+			}
+			c.Renames[parts[0]] = parts[1]
+		}
+	}
+	var err error
+	if c.Source, err = dial(*source, *sourceCA, *sourceCert, *sourceKey); err != nil {
+		log.Fatal(err)
+	}
+	if c.Destination, err = dial(
+		*destination,
+		*destinationCA,
+		*destinationCert,
+		*destinationKey,
+	); err != nil {
+		log.Fatal(err)
+	}
+	m, err := mirror.New(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		os.Interrupt,
+		syscall.SIGTERM,
+	)
+	defer stop()
+	if err = m.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("mirrored %s up to offset %d\n", *source, m.Next())
+}
+
+func dial(addr, caFile, certFile, keyFile string) (api.LogClient, error) {
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   caFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+	cc, err := grpc.Dial(
+		addr,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return api.NewLogClient(cc), nil
+}
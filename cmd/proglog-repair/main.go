@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+	"github.com/Franklynoble/proglog/internal/config"
+	plog "github.com/Franklynoble/proglog/internal/log"
+	"github.com/Franklynoble/proglog/internal/verify"
+)
+
+/*
+proglog-repair brings the log in a directory back in line with a reference
+server's. It finds the first offset the two diverge at by comparing checksums
+of offset ranges, truncates the local log there and fetches only the records
+it's missing from the reference. Stop the server serving the directory
+before repairing it.
+
+	proglog-repair [flags] -dir log-dir -reference addr
+*/
+func main() {
+	dir := flag.String("dir", "", "directory holding the log's segments")
+	reference := flag.String("reference", "", "address of the reference server")
+	caFile := flag.String("ca", config.CAFile, "CA certificate file")
+	certFile := flag.String("cert", config.RootClientCertFile, "client certificate file")
+	keyFile := flag.String("key", config.RootClientKeyFile, "client key file")
+	maxStoreBytes := flag.Uint64("segment-max-store-bytes", 1024, "the log's maximum store size")
+	maxIndexBytes := flag.Uint64("segment-max-index-bytes", 1024, "the log's maximum index size")
+	timeout := flag.Duration("timeout", 10*time.Minute, "time allowed for the whole repair")
+	flag.Parse()
+	if *dir == "" || *reference == "" || flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: *certFile,
+		KeyFile:  *keyFile,
+		CAFile:   *caFile,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	cc, err := grpc.Dial(
+		*reference,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cc.Close()
+
+	c := plog.Config{}
+	c.Segment.MaxStoreBytes = *maxStoreBytes
+	c.Segment.MaxIndexBytes = *maxIndexBytes
+	l, err := plog.NewLog(*dir, c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	result, repairErr := verify.Repair(ctx, l, api.NewLogClient(cc))
+	// close the log either way so what was repaired is kept
+	if err = l.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if result.Truncated {
+		fmt.Printf("truncated the log from offset %d\n", result.Offset)
+	}
+	fmt.Printf("fetched %d records from %s\n", result.Fetched, *reference)
+	if repairErr != nil {
+		log.Fatal(repairErr)
+	}
+}
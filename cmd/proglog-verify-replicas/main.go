@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+	"github.com/Franklynoble/proglog/internal/config"
+	"github.com/Franklynoble/proglog/internal/verify"
+)
+
+/*
+proglog-verify-replicas checks that servers hold the same records. It compares
+every server against the first one, the reference, range by range using the
+checksums the servers compute over their logs, and reports the first offset
+each server diverges at. It exits with status 1 when any server diverged.
+
+	proglog-verify-replicas [flags] reference-addr replica-addr...
+*/
+func main() {
+	caFile := flag.String("ca", config.CAFile, "CA certificate file")
+	certFile := flag.String("cert", config.RootClientCertFile, "client certificate file")
+	keyFile := flag.String("key", config.RootClientKeyFile, "client key file")
+	timeout := flag.Duration("timeout", time.Minute, "time allowed for the whole check")
+	flag.Usage = func() {
+		fmt.Fprintf(
+			flag.CommandLine.Output(),
+			"usage: %s [flags] reference-addr replica-addr...\n",
+			os.Args[0],
+		)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: *certFile,
+		KeyFile:  *keyFile,
+		CAFile:   *caFile,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	addrs := flag.Args()
+	reference, err := dial(addrs[0], opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	diverged := false
+	for _, addr := range addrs[1:] {
+		replica, err := dial(addr, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		result, err := verify.Compare(ctx, reference, replica)
+		if err != nil {
+			log.Fatalf("comparing %s with %s: %v", addr, addrs[0], err)
+		}
+		report(addr, addrs[0], result)
+		diverged = diverged || result.Diverged
+	}
+	if diverged {
+		os.Exit(1)
+	}
+}
+
+func dial(addr string, opts []grpc.DialOption) (verify.Source, error) {
+	cc, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return verify.Client(api.NewLogClient(cc)), nil
+}
+
+func report(addr, reference string, result verify.Result) {
+	switch {
+	case result.Diverged:
+		fmt.Printf(
+			"%s: diverges from %s at offset %d\n",
+			addr, reference, result.Offset,
+		)
+	case result.Start == result.End:
+		fmt.Printf("%s: no offsets in common with %s\n", addr, reference)
+	default:
+		fmt.Printf(
+			"%s: matches %s on offsets %d to %d\n",
+			addr, reference, result.Start, result.End-1,
+		)
+	}
+	if !result.Diverged && result.ReplicaEnd != result.ReferenceEnd {
+		fmt.Printf(
+			"%s: next offset is %d, %s's is %d\n",
+			addr, result.ReplicaEnd, reference, result.ReferenceEnd,
+		)
+	}
+}
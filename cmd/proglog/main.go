@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Franklynoble/proglog/internal/agent"
+	"github.com/Franklynoble/proglog/internal/config"
+)
+
+/*
+proglog runs a server node, serving gRPC and HTTP on its one bind address. It's
+configured with a YAML file, with flags overriding the file's settings:
+
+	data-dir: /var/lib/proglog
+	bind-addr: 0.0.0.0:8400
+	tls:
+	  cert-file: server.pem
+	  key-file: server-key.pem
+	  ca-file: ca.pem
+	acl:
+	  model-file: model.conf
+	  policy-file: policy.csv
+	segment:
+	  max-store-bytes: 1048576
+	  max-index-bytes: 1048576
+	sync-interval: 0s
+	shutdown-timeout: 10s
+
+The sync interval is how often the log syncs its records to disk. At 0 every
+produce syncs its record before it's acknowledged, which costs a disk sync per
+record; a longer interval batches the syncs, acknowledging records a crash may
+still lose until the next one.
+
+It shuts down gracefully on SIGINT and SIGTERM, ending the streams and waiting
+up to the shutdown timeout for the calls in flight before closing the log.
+
+	proglog [-config file] [flags]
+*/
+func main() {
+	cfg := cfg{
+		DataDir:  os.TempDir() + "/proglog",
+		BindAddr: "127.0.0.1:8400",
+	}
+	cfg.TLS.CertFile = config.ServerCertFile
+	cfg.TLS.KeyFile = config.ServerKeyFile
+	cfg.TLS.CAFile = config.CAFile
+	cfg.ACL.ModelFile = config.ACLModelFile
+	cfg.ACL.PolicyFile = config.ACLPolicyFile
+	cfg.Segment.MaxStoreBytes = 1024
+	cfg.Segment.MaxIndexBytes = 1024
+	cfg.ShutdownTimeout = 10 * time.Second
+
+	configFile := flag.String("config", "", "YAML config file")
+	flag.StringVar(&cfg.DataDir, "data-dir", cfg.DataDir, "directory to store the log in")
+	flag.StringVar(&cfg.BindAddr, "bind-addr", cfg.BindAddr, "address to serve gRPC and HTTP on")
+	flag.StringVar(&cfg.TLS.CertFile, "tls-cert-file", cfg.TLS.CertFile, "server certificate file")
+	flag.StringVar(&cfg.TLS.KeyFile, "tls-key-file", cfg.TLS.KeyFile, "server key file")
+	flag.StringVar(&cfg.TLS.CAFile, "tls-ca-file", cfg.TLS.CAFile, "CA certificate file clients' certificates are verified with")
+	flag.StringVar(&cfg.ACL.ModelFile, "acl-model-file", cfg.ACL.ModelFile, "ACL model file")
+	flag.StringVar(&cfg.ACL.PolicyFile, "acl-policy-file", cfg.ACL.PolicyFile, "ACL policy file")
+	flag.Uint64Var(&cfg.Segment.MaxStoreBytes, "segment-max-store-bytes", cfg.Segment.MaxStoreBytes, "maximum size of a segment's store")
+	flag.Uint64Var(&cfg.Segment.MaxIndexBytes, "segment-max-index-bytes", cfg.Segment.MaxIndexBytes, "maximum size of a segment's index")
+	flag.DurationVar(&cfg.SyncInterval, "sync-interval", cfg.SyncInterval, "how often the log syncs its records to disk, 0 syncing every record")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "how long a shutdown waits for the calls in flight")
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *configFile != "" {
+		if err := cfg.load(*configFile); err != nil {
+			log.Fatal(err)
+		}
+		// the flags set on the command line win over the file
+		if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	agentConfig, err := cfg.agentConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	a, err := agent.New(agentConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("serving %s on %s", cfg.DataDir, a.Addr())
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-sigc:
+		log.Printf("shutting down on %s", sig)
+	case <-a.Done():
+		log.Fatal("the server stopped serving")
+	}
+	if err = a.Shutdown(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// cfg is the command's configuration as the YAML file holds it.
+type cfg struct {
+	DataDir  string `yaml:"data-dir"`
+	BindAddr string `yaml:"bind-addr"`
+	TLS      struct {
+		CertFile string `yaml:"cert-file"`
+		KeyFile  string `yaml:"key-file"`
+		CAFile   string `yaml:"ca-file"`
+	} `yaml:"tls"`
+	ACL struct {
+		ModelFile  string `yaml:"model-file"`
+		PolicyFile string `yaml:"policy-file"`
+	} `yaml:"acl"`
+	Segment struct {
+		MaxStoreBytes uint64 `yaml:"max-store-bytes"`
+		MaxIndexBytes uint64 `yaml:"max-index-bytes"`
+	} `yaml:"segment"`
+	SyncInterval    time.Duration `yaml:"sync-interval"`
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout"`
+}
+
+// load sets the settings the YAML file holds, leaving the others as they are.
+func (c *cfg) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err = dec.Decode(c); err != nil {
+		return fmt.Errorf("reading %s: %w", file, err)
+	}
+	return nil
+}
+
+func (c *cfg) agentConfig() (agent.Config, error) {
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: c.TLS.CertFile,
+		KeyFile:  c.TLS.KeyFile,
+		CAFile:   c.TLS.CAFile,
+		Server:   true,
+	})
+	if err != nil {
+		return agent.Config{}, err
+	}
+	ac := agent.Config{
+		DataDir:         c.DataDir,
+		BindAddr:        c.BindAddr,
+		ServerTLSConfig: tlsConfig,
+		ACLModelFile:    c.ACL.ModelFile,
+		ACLPolicyFile:   c.ACL.PolicyFile,
+		ShutdownTimeout: c.ShutdownTimeout,
+	}
+	ac.Log.Segment.MaxStoreBytes = c.Segment.MaxStoreBytes
+	ac.Log.Segment.MaxIndexBytes = c.Segment.MaxIndexBytes
+	ac.Log.Durability.SyncInterval = c.SyncInterval
+	return ac, nil
+}
@@ -0,0 +1,294 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc"
+
+	"github.com/Franklynoble/proglog/internal/auth"
+	"github.com/Franklynoble/proglog/internal/coordinator"
+	"github.com/Franklynoble/proglog/internal/log"
+	"github.com/Franklynoble/proglog/internal/server"
+)
+
+// Config configures an Agent.
+type Config struct {
+	// DataDir holds the log's segments.
+	DataDir string
+	// BindAddr is the address the agent serves gRPC and HTTP on.
+	BindAddr string
+	// ServerTLSConfig secures the server and verifies the clients'
+	// certificates, whose common names the ACL files authorize.
+	ServerTLSConfig *tls.Config
+	ACLModelFile    string
+	ACLPolicyFile   string
+	// Log configures the log, like its segment sizes and how often it
+	// syncs its records.
+	Log log.Config
+	// Partitions is how many partitions consumer groups split the log
+	// into.
+	Partitions uint32
+	// ShutdownTimeout bounds how long Shutdown waits for the RPCs in
+	// flight, defaultShutdownTimeout if it's 0.
+	ShutdownTimeout time.Duration
+}
+
+/*
+Agent runs a server node: it opens the log in the data dir and serves it over
+gRPC and HTTPS on one port, with mTLS, authorizing clients with the ACL, until
+it's shut down.
+
+The HTTP server terminates TLS for both APIs and hands the gRPC requests to
+the gRPC server's experimental ServeHTTP, so the gRPC server never serves a
+connection itself. Its GracefulStop doesn't wait for RPCs served that way, so
+Shutdown drains them through the servers' ShuttingDown channel and
+http.Server.Shutdown instead. Server options acting on connections, like
+keepalive parameters and MaxConcurrentStreams, don't apply either.
+*/
+type Agent struct {
+	Config
+
+	log         *log.Log
+	coordinator *coordinator.Coordinator
+	server      *grpc.Server
+	httpServer  *http.Server
+	// mux splits the connections to the listener by protocol, tlsListener
+	// accepts the TLS ones
+	listener    net.Listener
+	mux         cmux.CMux
+	tlsListener net.Listener
+
+	// draining is closed when the shutdown starts, to drain the servers
+	draining chan struct{}
+	// webSockets counts the WebSocket connections, which the HTTP server's
+	// Shutdown doesn't wait for
+	webSockets   sync.WaitGroup
+	shutdown     bool
+	shutdowns    chan struct{}
+	shutdownLock sync.Mutex
+}
+
+// New creates an agent and starts serving.
+func New(config Config) (*Agent, error) {
+	if config.ServerTLSConfig == nil {
+		return nil, fmt.Errorf("an agent needs a server TLS config")
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+	a := &Agent{
+		Config:    config,
+		draining:  make(chan struct{}),
+		shutdowns: make(chan struct{}),
+	}
+	setup := []func() error{
+		a.setupLog,
+		a.setupMux,
+		a.setupServer,
+	}
+	for _, fn := range setup {
+		if err := fn(); err != nil {
+			a.Shutdown()
+			return nil, err
+		}
+	}
+	go a.serve()
+	return a, nil
+}
+
+func (a *Agent) setupLog() error {
+	if err := os.MkdirAll(a.DataDir, 0755); err != nil {
+		return err
+	}
+	var err error
+	a.log, err = log.NewLog(a.DataDir, a.Config.Log)
+	return err
+}
+
+/*
+setupMux listens on the bind address and multiplexes the connections by their
+first bytes, so every protocol the node speaks shares its one port. It matches
+only TLS connections, which carry both gRPC and HTTP; a protocol added later
+gets its own matcher ahead of the TLS one.
+*/
+func (a *Agent) setupMux() error {
+	var err error
+	if a.listener, err = net.Listen("tcp", a.BindAddr); err != nil {
+		return err
+	}
+	a.mux = cmux.New(a.listener)
+	a.tlsListener = a.mux.Match(cmux.TLS())
+	return nil
+}
+
+func (a *Agent) setupServer() error {
+	a.coordinator = coordinator.New(coordinator.Config{
+		Partitions: a.Partitions,
+	})
+	serverConfig := &server.Config{
+		CommitLog:    a.log,
+		Authorizer:   auth.New(a.ACLModelFile, a.ACLPolicyFile),
+		Coordinator:  a.coordinator,
+		ShuttingDown: a.draining,
+		WebSockets:   &a.webSockets,
+	}
+	var err error
+	// the HTTP server terminates TLS for both APIs, the gRPC server reads
+	// the client's certificate off the requests it hands it
+	if a.server, err = server.NEWGRPCServer(serverConfig); err != nil {
+		return err
+	}
+	a.httpServer, err = server.NewHTTPServer(a.BindAddr, serverConfig)
+	if err != nil {
+		return err
+	}
+	a.httpServer.Handler = grpcHandler(a.server, a.httpServer.Handler)
+	a.httpServer.TLSConfig = a.ServerTLSConfig
+	return nil
+}
+
+// grpcHandler routes the HTTP/2 requests with a gRPC content type to the gRPC
+// server and the others to the HTTP API.
+func grpcHandler(grpcServer *grpc.Server, other http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(
+			r.Header.Get("Content-Type"),
+			"application/grpc",
+		) {
+			grpcServer.ServeHTTP(w, r)
+			return
+		}
+		other.ServeHTTP(w, r)
+	})
+}
+
+func (a *Agent) serve() {
+	go func() {
+		err := a.httpServer.ServeTLS(a.tlsListener, "", "")
+		if err != http.ErrServerClosed {
+			_ = a.Shutdown()
+		}
+	}()
+	// Serve fails once Shutdown closed the listener, or when the agent
+	// couldn't accept connections; the node is of no use then
+	_ = a.mux.Serve()
+	_ = a.Shutdown()
+}
+
+// Addr returns the address the agent serves on, useful when BindAddr's port is
+// 0.
+func (a *Agent) Addr() string {
+	return a.listener.Addr().String()
+}
+
+// Done is closed once the agent has shut down.
+func (a *Agent) Done() <-chan struct{} {
+	return a.shutdowns
+}
+
+// defaultShutdownTimeout is how long Shutdown waits for the RPCs in flight
+// when the config doesn't say.
+const defaultShutdownTimeout = 10 * time.Second
+
+/*
+Shutdown drains the agent and closes it. The streams, like ConsumeStream
+subscriptions, end with api.ErrShuttingDown, and so do the RPCs arriving
+meanwhile, while the agent stops accepting connections and waits up to
+ShutdownTimeout for the RPCs in flight, like Produce calls, to finish; the
+ones still running then are cut off, and their appends fail once the log is
+closed. The WebSockets close going away. It then waits for their last
+produces and closes the log, which flushes and syncs its segments, so every
+record it acknowledged survives the process exiting. A step that fails
+doesn't stop the ones after it, and Shutdown returns the first error. Calling
+it again does nothing.
+*/
+func (a *Agent) Shutdown() error {
+	a.shutdownLock.Lock()
+	defer a.shutdownLock.Unlock()
+	if a.shutdown {
+		return nil
+	}
+	a.shutdown = true
+	defer close(a.shutdowns)
+
+	shutdown := []func() error{
+		func() error {
+			// streams end and new RPCs fail from now on, so only
+			// the calls in flight hold the shutdown up
+			close(a.draining)
+			return nil
+		},
+		func() error {
+			if a.httpServer == nil {
+				return nil
+			}
+			// waits for the pending HTTP requests and RPCs alike
+			ctx, cancel := context.WithTimeout(
+				context.Background(),
+				a.ShutdownTimeout,
+			)
+			defer cancel()
+			if err := a.httpServer.Shutdown(ctx); err != nil {
+				// the deadline passed, cut the calls left off
+				return a.httpServer.Close()
+			}
+			return nil
+		},
+		func() error {
+			if a.listener != nil {
+				// the HTTP server closed it already unless it
+				// hadn't started serving
+				_ = a.listener.Close()
+			}
+			return nil
+		},
+		func() error {
+			if a.server != nil {
+				// the gRPC server is served through the HTTP
+				// server, which drained its RPCs already: its
+				// GracefulStop can't drain RPCs served that way
+				a.server.Stop()
+			}
+			return nil
+		},
+		func() error {
+			if a.coordinator != nil {
+				return a.coordinator.Close()
+			}
+			return nil
+		},
+		func() error {
+			// the WebSockets closed when the agent started
+			// draining, but their last produces may still be
+			// appending
+			a.webSockets.Wait()
+			return nil
+		},
+		func() error {
+			if a.log != nil {
+				// handlers the deadline cut off may still be
+				// running, but the closed log fails their appends
+				return a.log.Close()
+			}
+			return nil
+		},
+	}
+	// every step runs, so a server that failed to stop still leaves the
+	// log closed, and the first error is the one returned
+	var err error
+	for _, fn := range shutdown {
+		if ferr := fn(); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
@@ -0,0 +1,225 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+	"github.com/Franklynoble/proglog/internal/config"
+)
+
+func TestAgent(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.ServerCertFile,
+		KeyFile:  config.ServerKeyFile,
+		CAFile:   config.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "agent-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{
+		DataDir:         dir,
+		BindAddr:        "127.0.0.1:0",
+		ServerTLSConfig: serverTLSConfig,
+		ACLModelFile:    config.ACLModelFile,
+		ACLPolicyFile:   config.ACLPolicyFile,
+	}
+	a, err := New(c)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	client := newClient(t, a.Addr())
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	require.NoError(t, a.Shutdown())
+	<-a.Done()
+	// a second shutdown does nothing
+	require.NoError(t, a.Shutdown())
+
+	// the records survive the restart
+	a, err = New(c)
+	require.NoError(t, err)
+	defer a.Shutdown()
+	client = newClient(t, a.Addr())
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+}
+
+func TestAgentSinglePort(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.ServerCertFile,
+		KeyFile:  config.ServerKeyFile,
+		CAFile:   config.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "agent-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a, err := New(Config{
+		DataDir:         dir,
+		BindAddr:        "127.0.0.1:0",
+		ServerTLSConfig: serverTLSConfig,
+		ACLModelFile:    config.ACLModelFile,
+		ACLPolicyFile:   config.ACLPolicyFile,
+	})
+	require.NoError(t, err)
+	defer a.Shutdown()
+
+	// gRPC and HTTP share the agent's address
+	produce, err := newClient(t, a.Addr()).Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		},
+	)
+	require.NoError(t, err)
+
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.RootClientCertFile,
+		KeyFile:  config.RootClientKeyFile,
+		CAFile:   config.CAFile,
+	})
+	require.NoError(t, err)
+	for _, forceHTTP2 := range []bool{false, true} {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   clientTLSConfig.Clone(),
+			ForceAttemptHTTP2: forceHTTP2,
+		}}
+		resp, err := client.Get(fmt.Sprintf(
+			"https://%s/records/%d",
+			a.Addr(),
+			produce.Offset,
+		))
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		var consume api.ConsumeResponse
+		require.NoError(t, protojson.Unmarshal(b, &consume))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, []byte("hello world"), consume.Record.Value)
+		if forceHTTP2 {
+			require.Equal(t, 2, resp.ProtoMajor)
+		}
+	}
+
+	// the agent closes connections speaking no protocol it knows
+	conn, err := net.Dial("tcp", a.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	netErr, ok := err.(net.Error)
+	require.False(t, ok && netErr.Timeout())
+}
+
+func TestAgentShutdownDrainsStreams(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.ServerCertFile,
+		KeyFile:  config.ServerKeyFile,
+		CAFile:   config.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "agent-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{
+		DataDir:         dir,
+		BindAddr:        "127.0.0.1:0",
+		ServerTLSConfig: serverTLSConfig,
+		ACLModelFile:    config.ACLModelFile,
+		ACLPolicyFile:   config.ACLPolicyFile,
+		ShutdownTimeout: 5 * time.Second,
+	}
+	a, err := New(c)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	client := newClient(t, a.Addr())
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset + 1,
+	})
+	require.NoError(t, err)
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.RootClientCertFile,
+		KeyFile:  config.RootClientKeyFile,
+		CAFile:   config.CAFile,
+	})
+	require.NoError(t, err)
+	dialer := websocket.Dialer{TLSClientConfig: clientTLSConfig}
+	ws, _, err := dialer.Dial(fmt.Sprintf("wss://%s/ws", a.Addr()), nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	// the subscribers end with a status telling them why, rather than
+	// holding the shutdown up until its deadline
+	start := time.Now()
+	shutdown := make(chan error)
+	go func() { shutdown <- a.Shutdown() }()
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	ws.SetReadDeadline(time.Now().Add(c.ShutdownTimeout))
+	_, _, err = ws.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+	require.NoError(t, <-shutdown)
+	require.True(t, time.Since(start) < c.ShutdownTimeout)
+
+	a, err = New(c)
+	require.NoError(t, err)
+	defer a.Shutdown()
+	consume, err := newClient(t, a.Addr()).Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+}
+
+func newClient(t *testing.T, addr string) api.LogClient {
+	t.Helper()
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.RootClientCertFile,
+		KeyFile:  config.RootClientKeyFile,
+		CAFile:   config.CAFile,
+	})
+	require.NoError(t, err)
+	cc, err := grpc.Dial(
+		addr,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { cc.Close() })
+	return api.NewLogClient(cc)
+}
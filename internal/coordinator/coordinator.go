@@ -0,0 +1,263 @@
+package coordinator
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+)
+
+/*
+The coordinator lets the consumers of a group share the log. It splits the log
+into virtual partitions, a record belonging to partition offset % Partitions,
+and assigns each member of a group a disjoint set of partitions with the
+configured Strategy. Members keep their membership alive with heartbeats; a
+member joining, leaving or missing heartbeats for SessionTimeout triggers a
+rebalance that bumps the group's generation. Members of an older generation
+are fenced: they can't consume or commit offsets until they pick up the new
+generation.
+*/
+type Config struct {
+	Partitions     uint32
+	SessionTimeout time.Duration
+	Strategy       Strategy
+}
+
+type Coordinator struct {
+	Config
+
+	mu     sync.Mutex
+	groups map[string]*group
+	now    func() time.Time
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type group struct {
+	generation uint64
+	heartbeats map[string]time.Time
+	assignment map[string][]uint32
+}
+
+// Membership is a member's view of its group after a join or heartbeat.
+type Membership struct {
+	MemberID       string
+	Generation     uint64
+	Partitions     []uint32
+	PartitionCount uint32
+}
+
+// New creates a coordinator and starts expiring the members that stop
+// heartbeating. Close stops it.
+func New(config Config) *Coordinator {
+	if config.Partitions == 0 {
+		config.Partitions = 16
+	}
+	if config.SessionTimeout == 0 {
+		config.SessionTimeout = 10 * time.Second
+	}
+	if config.Strategy == nil {
+		config.Strategy = Range{}
+	}
+	c := &Coordinator{
+		Config: config,
+		groups: make(map[string]*group),
+		now:    time.Now,
+		closed: make(chan struct{}),
+	}
+	go c.expireLoop()
+	return c
+}
+
+// Join adds the member to the group, rebalancing it, and returns the
+// member's assignment. An empty memberID gets a generated one.
+func (c *Coordinator) Join(groupID, memberID string) (Membership, error) {
+	if memberID == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return Membership{}, err
+		}
+		memberID = hex.EncodeToString(b)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, ok := c.groups[groupID]
+	if !ok {
+		g = &group{heartbeats: make(map[string]time.Time)}
+		c.groups[groupID] = g
+	}
+	_, joined := g.heartbeats[memberID]
+	g.heartbeats[memberID] = c.now()
+	if !joined {
+		c.rebalance(g)
+	}
+	return g.membership(memberID, c.Partitions), nil
+}
+
+// Heartbeat keeps the member alive and returns its current assignment, which
+// changes along with the generation after a rebalance.
+func (c *Coordinator) Heartbeat(groupID, memberID string) (Membership, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, ok := c.groups[groupID]
+	if !ok {
+		return Membership{}, api.ErrFencedMember{
+			Group:    groupID,
+			MemberID: memberID,
+		}
+	}
+	if _, ok := g.heartbeats[memberID]; !ok {
+		return Membership{}, api.ErrFencedMember{
+			Group:      groupID,
+			MemberID:   memberID,
+			Generation: g.generation,
+		}
+	}
+	g.heartbeats[memberID] = c.now()
+	return g.membership(memberID, c.Partitions), nil
+}
+
+// Leave removes the member from the group and rebalances the rest.
+func (c *Coordinator) Leave(groupID, memberID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, ok := c.groups[groupID]
+	if !ok {
+		return nil
+	}
+	if _, ok := g.heartbeats[memberID]; !ok {
+		return nil
+	}
+	delete(g.heartbeats, memberID)
+	c.rebalanceOrRemove(groupID, g)
+	return nil
+}
+
+/*
+Validate fences members that aren't part of the group's current generation.
+Callers that don't name a member pass as long as the group has no members, so
+groups that don't use the coordinator keep committing offsets as before.
+*/
+func (c *Coordinator) Validate(groupID, memberID string, generation uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.validate(groupID, memberID, generation)
+	return err
+}
+
+// Assignment returns the partitions of the member's current generation.
+func (c *Coordinator) Assignment(
+	groupID, memberID string,
+	generation uint64,
+) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, err := c.validate(groupID, memberID, generation)
+	if err != nil {
+		return nil, err
+	}
+	return append([]uint32(nil), g.assignment[memberID]...), nil
+}
+
+// Partition returns the partition the offset belongs to.
+func (c *Coordinator) Partition(offset uint64) uint32 {
+	return uint32(offset % uint64(c.Partitions))
+}
+
+// Close stops expiring members.
+func (c *Coordinator) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *Coordinator) validate(
+	groupID, memberID string,
+	generation uint64,
+) (*group, error) {
+	g, ok := c.groups[groupID]
+	if memberID == "" && (!ok || len(g.heartbeats) == 0) {
+		return &group{}, nil
+	}
+	fenced := api.ErrFencedMember{
+		Group:      groupID,
+		MemberID:   memberID,
+		Generation: generation,
+	}
+	if !ok {
+		return nil, fenced
+	}
+	if _, ok := g.heartbeats[memberID]; !ok || g.generation != generation {
+		return nil, fenced
+	}
+	return g, nil
+}
+
+func (c *Coordinator) rebalance(g *group) {
+	members := make([]string, 0, len(g.heartbeats))
+	for member := range g.heartbeats {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	g.assignment = c.Strategy.Assign(members, c.Partitions, g.assignment)
+	g.generation++
+}
+
+func (c *Coordinator) expireLoop() {
+	ticker := time.NewTicker(c.SessionTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			c.expire()
+		}
+	}
+}
+
+// expire removes the members whose session timed out and rebalances their
+// groups, removing the groups left empty.
+func (c *Coordinator) expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deadline := c.now().Add(-c.SessionTimeout)
+	for groupID, g := range c.groups {
+		expired := false
+		for member, heartbeat := range g.heartbeats {
+			if heartbeat.Before(deadline) {
+				delete(g.heartbeats, member)
+				expired = true
+			}
+		}
+		if expired {
+			c.rebalanceOrRemove(groupID, g)
+		}
+	}
+}
+
+// rebalanceOrRemove rebalances the group after members left it, or forgets
+// the group once its last member left, so the groups clients name don't pile
+// up. A member of a removed group is fenced like any member that isn't part
+// of its group.
+func (c *Coordinator) rebalanceOrRemove(groupID string, g *group) {
+	if len(g.heartbeats) == 0 {
+		delete(c.groups, groupID)
+		return
+	}
+	c.rebalance(g)
+}
+
+func (g *group) membership(memberID string, partitions uint32) Membership {
+	return Membership{
+		MemberID:       memberID,
+		Generation:     g.generation,
+		Partitions:     append([]uint32(nil), g.assignment[memberID]...),
+		PartitionCount: partitions,
+	}
+}
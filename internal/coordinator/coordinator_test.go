@@ -0,0 +1,114 @@
+package coordinator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+)
+
+func TestStrategies(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	for name, tc := range map[string]struct {
+		strategy Strategy
+		want     map[string][]uint32
+	}{
+		"range": {
+			strategy: Range{},
+			want: map[string][]uint32{
+				"a": {0, 1, 2},
+				"b": {3, 4},
+				"c": {5, 6},
+			},
+		},
+		"round robin": {
+			strategy: RoundRobin{},
+			want: map[string][]uint32{
+				"a": {0, 3, 6},
+				"b": {1, 4},
+				"c": {2, 5},
+			},
+		},
+		"sticky": {
+			strategy: Sticky{},
+			want: map[string][]uint32{
+				"a": {0, 3, 6},
+				"b": {1, 4},
+				"c": {2, 5},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := tc.strategy.Assign(members, 7, nil)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+// tests that the sticky strategy only moves the partitions of the member
+// that left
+func TestStickyKeepsPartitions(t *testing.T) {
+	prev := map[string][]uint32{
+		"a": {0, 1},
+		"b": {2, 3},
+		"c": {4, 5},
+	}
+	got := Sticky{}.Assign([]string{"a", "c"}, 6, prev)
+	require.Subset(t, got["a"], prev["a"])
+	require.Subset(t, got["c"], prev["c"])
+	require.Len(t, got["a"], 3)
+	require.Len(t, got["c"], 3)
+}
+
+func TestCoordinator(t *testing.T) {
+	c := New(Config{Partitions: 4, SessionTimeout: time.Hour})
+	defer c.Close()
+
+	a, err := c.Join("group", "a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), a.Generation)
+	require.Equal(t, []uint32{0, 1, 2, 3}, a.Partitions)
+
+	b, err := c.Join("group", "b")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), b.Generation)
+	require.Equal(t, []uint32{2, 3}, b.Partitions)
+
+	// a missed the rebalance
+	fenced := api.ErrFencedMember{Group: "group", MemberID: "a", Generation: 1}
+	require.Equal(t, fenced, c.Validate("group", "a", 1))
+	_, err = c.Assignment("group", "a", 1)
+	require.Equal(t, fenced, err)
+
+	a, err = c.Heartbeat("group", "a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), a.Generation)
+	require.Equal(t, []uint32{0, 1}, a.Partitions)
+	require.NoError(t, c.Validate("group", "a", 2))
+
+	// commits without a member are fenced once the group has members
+	require.Error(t, c.Validate("group", "", 0))
+	require.NoError(t, c.Validate("other", "", 0))
+
+	require.NoError(t, c.Leave("group", "b"))
+	partitions, err := c.Assignment("group", "a", 3)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0, 1, 2, 3}, partitions)
+
+	// a's session times out
+	now := time.Now()
+	c.now = func() time.Time { return now.Add(2 * time.Hour) }
+	c.expire()
+	_, err = c.Heartbeat("group", "a")
+	require.Error(t, err)
+	require.NoError(t, c.Validate("group", "", 0))
+
+	// empty groups are forgotten, whether their last member expired or left
+	require.Empty(t, c.groups)
+	_, err = c.Join("other", "c")
+	require.NoError(t, err)
+	require.NoError(t, c.Leave("other", "c"))
+	require.Empty(t, c.groups)
+}
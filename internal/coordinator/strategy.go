@@ -0,0 +1,121 @@
+package coordinator
+
+import (
+	"sort"
+)
+
+/*
+Strategy decides which partitions each member of a group consumes. Assign gets
+the group's members sorted by ID, the number of partitions and the assignment
+of the previous generation, and returns a disjoint assignment covering every
+partition.
+*/
+type Strategy interface {
+	Assign(
+		members []string,
+		partitions uint32,
+		prev map[string][]uint32,
+	) map[string][]uint32
+}
+
+// Range hands each member a contiguous block of partitions.
+type Range struct{}
+
+func (Range) Assign(
+	members []string,
+	partitions uint32,
+	_ map[string][]uint32,
+) map[string][]uint32 {
+	assignment := make(map[string][]uint32, len(members))
+	if len(members) == 0 {
+		return assignment
+	}
+	n := uint32(len(members))
+	quota, extra := partitions/n, partitions%n
+	var p uint32
+	for i, member := range members {
+		size := quota
+		if uint32(i) < extra {
+			size++
+		}
+		for j := uint32(0); j < size; j++ {
+			assignment[member] = append(assignment[member], p)
+			p++
+		}
+	}
+	return assignment
+}
+
+// RoundRobin deals the partitions out to the members one at a time.
+type RoundRobin struct{}
+
+func (RoundRobin) Assign(
+	members []string,
+	partitions uint32,
+	_ map[string][]uint32,
+) map[string][]uint32 {
+	assignment := make(map[string][]uint32, len(members))
+	if len(members) == 0 {
+		return assignment
+	}
+	for p := uint32(0); p < partitions; p++ {
+		member := members[p%uint32(len(members))]
+		assignment[member] = append(assignment[member], p)
+	}
+	return assignment
+}
+
+/*
+Sticky keeps as many of the members' previous partitions as a balanced
+assignment allows, so a rebalance moves only the partitions of members that
+left and the ones needed to even out the members that joined.
+*/
+type Sticky struct{}
+
+func (Sticky) Assign(
+	members []string,
+	partitions uint32,
+	prev map[string][]uint32,
+) map[string][]uint32 {
+	assignment := make(map[string][]uint32, len(members))
+	if len(members) == 0 {
+		return assignment
+	}
+	n := uint32(len(members))
+	quota, extra := partitions/n, partitions%n
+	taken := make(map[uint32]bool, partitions)
+	for _, member := range members {
+		limit := quota
+		if extra > 0 && uint32(len(prev[member])) > quota {
+			limit++
+			extra--
+		}
+		for _, p := range prev[member] {
+			if uint32(len(assignment[member])) == limit {
+				break
+			}
+			if p < partitions && !taken[p] {
+				assignment[member] = append(assignment[member], p)
+				taken[p] = true
+			}
+		}
+	}
+	for p := uint32(0); p < partitions; p++ {
+		if taken[p] {
+			continue
+		}
+		least := members[0]
+		for _, member := range members[1:] {
+			if len(assignment[member]) < len(assignment[least]) {
+				least = member
+			}
+		}
+		assignment[least] = append(assignment[least], p)
+	}
+	for _, assigned := range assignment {
+		sort.Slice(assigned, func(i, j int) bool {
+			return assigned[i] < assigned[j]
+		})
+	}
+	return assignment
+}
@@ -0,0 +1,153 @@
+package discovery
+
+import (
+	"log"
+	"net"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+)
+
+/*
+Membership wraps a Serf instance to give the service cluster membership
+through gossip. A node joins the cluster through the seed addresses in
+Config.StartJoinAddrs, and every node learns about the others joining,
+leaving and failing. Membership passes those events, with each node's RPC
+address, to its Handler so the replication or consensus layer can start or
+stop copying the node's data.
+*/
+type Membership struct {
+	Config
+	handler Handler
+	serf    *serf.Serf
+	events  chan serf.Event
+}
+
+// Config configures a node's membership in the cluster.
+type Config struct {
+	// NodeName identifies the node in the cluster, it must be unique.
+	NodeName string
+	// BindAddr is the host:port the node gossips on.
+	BindAddr string
+	// Tags are shared with the other nodes, the service's RPC address goes
+	// under the rpc_addr tag.
+	Tags map[string]string
+	// StartJoinAddrs are the gossip addresses of nodes already in the
+	// cluster, empty for the cluster's first node.
+	StartJoinAddrs []string
+}
+
+// rpcAddrTag is the tag holding the node's RPC address.
+const rpcAddrTag = "rpc_addr"
+
+/*
+Handler is notified when other nodes join and leave the cluster. The
+Replicator and the DistributedLog both satisfy it. A failed node is handled as
+one that left.
+*/
+type Handler interface {
+	Join(name, addr string) error
+	Leave(name string) error
+}
+
+// New creates the node's Serf instance, joins the cluster and starts passing
+// membership events to handler.
+func New(handler Handler, config Config) (*Membership, error) {
+	m := &Membership{
+		Config:  config,
+		handler: handler,
+	}
+	if err := m.setupSerf(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Membership) setupSerf() error {
+	addr, err := net.ResolveTCPAddr("tcp", m.BindAddr)
+	if err != nil {
+		return err
+	}
+	config := serf.DefaultConfig()
+	config.Init()
+	config.MemberlistConfig.BindAddr = addr.IP.String()
+	config.MemberlistConfig.BindPort = addr.Port
+	m.events = make(chan serf.Event)
+	config.EventCh = m.events
+	config.Tags = m.Tags
+	config.NodeName = m.NodeName
+	m.serf, err = serf.Create(config)
+	if err != nil {
+		return err
+	}
+	go m.eventHandler()
+	if m.StartJoinAddrs != nil {
+		_, err = m.serf.Join(m.StartJoinAddrs, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Membership) eventHandler() {
+	for e := range m.events {
+		switch e.EventType() {
+		case serf.EventMemberJoin:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleJoin(member)
+			}
+		case serf.EventMemberLeave, serf.EventMemberFailed:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleLeave(member)
+			}
+		}
+	}
+}
+
+func (m *Membership) handleJoin(member serf.Member) {
+	if err := m.handler.Join(
+		member.Name,
+		member.Tags[rpcAddrTag],
+	); err != nil {
+		m.logError(err, "failed to join", member)
+	}
+}
+
+func (m *Membership) handleLeave(member serf.Member) {
+	if err := m.handler.Leave(member.Name); err != nil {
+		m.logError(err, "failed to leave", member)
+	}
+}
+
+func (m *Membership) isLocal(member serf.Member) bool {
+	return m.serf.LocalMember().Name == member.Name
+}
+
+// Members returns a point-in-time snapshot of the cluster's nodes.
+func (m *Membership) Members() []serf.Member {
+	return m.serf.Members()
+}
+
+// Leave tells the other nodes this node is leaving the cluster.
+func (m *Membership) Leave() error {
+	return m.serf.Leave()
+}
+
+func (m *Membership) logError(err error, msg string, member serf.Member) {
+	if err == raft.ErrNotLeader {
+		// only the leader changes the Raft cluster, every other node
+		// gets this error for each event
+		return
+	}
+	log.Printf(
+		"[ERROR] discovery: %s: %v: name=%s rpc_addr=%s",
+		msg, err, member.Name, member.Tags[rpcAddrTag],
+	)
+}
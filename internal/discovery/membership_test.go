@@ -0,0 +1,116 @@
+package discovery_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/Franklynoble/proglog/internal/discovery"
+	"github.com/Franklynoble/proglog/internal/log"
+)
+
+var (
+	_ Handler = (*log.Replicator)(nil)
+	_ Handler = (*log.DistributedLog)(nil)
+)
+
+// TestMembership runs a three node cluster on loopback and checks the
+// handlers see the nodes join and one of them leave.
+func TestMembership(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 2 &&
+			len(m[0].Members()) == 3 &&
+			len(handler.leaves) == 0
+	}, 3*time.Second, 250*time.Millisecond)
+
+	require.NoError(t, m[2].Leave())
+
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 2 &&
+			len(m[0].Members()) == 3 &&
+			status(m[0], "2") == serf.StatusLeft &&
+			len(handler.leaves) == 1
+	}, 3*time.Second, 250*time.Millisecond)
+
+	require.Equal(t, "2", <-handler.leaves)
+}
+
+func status(m *Membership, name string) serf.MemberStatus {
+	for _, member := range m.Members() {
+		if member.Name == name {
+			return member.Status
+		}
+	}
+	return serf.StatusNone
+}
+
+func setupMember(t *testing.T, members []*Membership) (
+	[]*Membership, *handler,
+) {
+	t.Helper()
+	id := len(members)
+	addr := freeAddr(t)
+	tags := map[string]string{
+		"rpc_addr": addr,
+	}
+	c := Config{
+		NodeName: fmt.Sprintf("%d", id),
+		BindAddr: addr,
+		Tags:     tags,
+	}
+	h := &handler{}
+	if len(members) == 0 {
+		h.joins = make(chan map[string]string, 3)
+		h.leaves = make(chan string, 3)
+	} else {
+		c.StartJoinAddrs = []string{
+			members[0].BindAddr,
+		}
+	}
+	m, err := New(h, c)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		m.Leave()
+	})
+	members = append(members, m)
+	return members, h
+}
+
+// freeAddr returns a loopback address with a port nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+type handler struct {
+	joins  chan map[string]string
+	leaves chan string
+}
+
+func (h *handler) Join(id, addr string) error {
+	if h.joins != nil {
+		h.joins <- map[string]string{
+			"id":   id,
+			"addr": addr,
+		}
+	}
+	return nil
+}
+
+func (h *handler) Leave(id string) error {
+	if h.leaves != nil {
+		h.leaves <- id
+	}
+	return nil
+}
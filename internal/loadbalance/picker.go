@@ -0,0 +1,89 @@
+package loadbalance
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+/*
+Picker routes each call to a server. Calls that write, like Produce and the
+transaction and group RPCs, go to the servers that accept writes, while the
+consuming calls round-robin across the other servers so reads don't load the
+servers taking the writes. Consuming calls fall back to the servers that
+accept writes when there are no others.
+*/
+type Picker struct {
+	// current comes first to keep it 64-bit aligned for atomic
+	current   uint64
+	leaders   []balancer.SubConn
+	followers []balancer.SubConn
+}
+
+var _ base.PickerBuilder = (*Picker)(nil)
+
+// Build creates a picker for the ready connections; gRPC rebuilds it whenever
+// the connections change.
+func (p *Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	p = &Picker{}
+	for sc, scInfo := range buildInfo.ReadySCs {
+		isLeader, _ := scInfo.Address.Attributes.Value(isLeaderKey{}).(bool)
+		if isLeader {
+			p.leaders = append(p.leaders, sc)
+			continue
+		}
+		p.followers = append(p.followers, sc)
+	}
+	return p
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+// reads are the methods a server that doesn't accept writes can serve.
+var reads = map[string]bool{
+	"Consume":       true,
+	"ConsumeStream": true,
+	"FetchOffset":   true,
+	"GetServers":    true,
+}
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	var result balancer.PickResult
+	method := info.FullMethodName[strings.LastIndex(info.FullMethodName, "/")+1:]
+	if reads[method] {
+		result.SubConn = p.nextFollower()
+	} else {
+		result.SubConn = p.nextLeader()
+	}
+	if result.SubConn == nil {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	return result, nil
+}
+
+func (p *Picker) nextFollower() balancer.SubConn {
+	if len(p.followers) == 0 {
+		return p.nextLeader()
+	}
+	return p.followers[p.next(len(p.followers))]
+}
+
+func (p *Picker) nextLeader() balancer.SubConn {
+	if len(p.leaders) == 0 {
+		return nil
+	}
+	return p.leaders[p.next(len(p.leaders))]
+}
+
+func (p *Picker) next(n int) int {
+	cur := atomic.AddUint64(&p.current, uint64(1))
+	return int(cur % uint64(n))
+}
+
+func init() {
+	balancer.Register(
+		base.NewBalancerBuilder(Name, &Picker{}, base.Config{}),
+	)
+}
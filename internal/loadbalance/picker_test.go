@@ -0,0 +1,95 @@
+package loadbalance
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestPickerNoSubConnAvailable(t *testing.T) {
+	picker := &Picker{}
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/Consume",
+	} {
+		info := balancer.PickInfo{
+			FullMethodName: method,
+		}
+		result, err := picker.Pick(info)
+		require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+		require.Nil(t, result.SubConn)
+	}
+}
+
+func TestPickerProducesToLeader(t *testing.T) {
+	picker, subConns := setupTest(2)
+	info := balancer.PickInfo{
+		FullMethodName: "/log.v1.Log/Produce",
+	}
+	for i := 0; i < 5; i++ {
+		gotPick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[0], gotPick.SubConn)
+	}
+}
+
+func TestPickerConsumesFromFollowers(t *testing.T) {
+	picker, subConns := setupTest(2)
+	info := balancer.PickInfo{
+		FullMethodName: "/log.v1.Log/Consume",
+	}
+	seen := make(map[balancer.SubConn]int)
+	for i := 0; i < 6; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.NotEqual(t, subConns[0], pick.SubConn)
+		seen[pick.SubConn]++
+	}
+	// round-robin spreads the calls evenly
+	require.Equal(t, 3, seen[subConns[1]])
+	require.Equal(t, 3, seen[subConns[2]])
+}
+
+func TestPickerConsumesFromLeaderWithoutFollowers(t *testing.T) {
+	picker, subConns := setupTest(0)
+	pick, err := picker.Pick(balancer.PickInfo{
+		FullMethodName: "/log.v1.Log/ConsumeStream",
+	})
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], pick.SubConn)
+}
+
+// setupTest builds a picker with a leader, subConns[0], and the followers.
+func setupTest(followers int) (*Picker, []*subConn) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for i := 0; i < followers+1; i++ {
+		sc := &subConn{}
+		addr := resolver.Address{
+			Attributes: attributes.New(isLeaderKey{}, i == 0),
+		}
+		// 0th sub conn is the leader
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	picker := (&Picker{}).Build(buildInfo).(*Picker)
+	return picker, subConns
+}
+
+// subConn implements balancer.SubConn.
+type subConn struct {
+	addrs []resolver.Address
+}
+
+func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
+	s.addrs = addrs
+}
+
+func (s *subConn) Connect() {}
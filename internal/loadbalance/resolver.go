@@ -0,0 +1,112 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+)
+
+/*
+Resolver discovers the servers of a proglog cluster. A client dials
+"proglog:///<addr>" with addr any server of the cluster; the Resolver asks that
+server for the cluster's servers with the GetServers RPC and hands their
+addresses to gRPC, marking the ones that accept writes so the Picker can route
+calls. gRPC asks the Resolver to resolve again whenever a connection fails, so
+the client follows the cluster as servers come and go.
+*/
+type Resolver struct {
+	mu            sync.Mutex
+	clientConn    resolver.ClientConn
+	resolverConn  *grpc.ClientConn
+	serviceConfig *serviceconfig.ParseResult
+}
+
+var _ resolver.Builder = (*Resolver)(nil)
+
+// Name is the scheme clients dial and the name of the balancer.
+const Name = "proglog"
+
+// isLeaderKey is the address attribute marking servers that accept writes.
+type isLeaderKey struct{}
+
+func init() {
+	resolver.Register(&Resolver{})
+}
+
+// Build creates a resolver for the client connection, the registered Resolver
+// is only the builder.
+func (*Resolver) Build(
+	target resolver.Target,
+	cc resolver.ClientConn,
+	opts resolver.BuildOptions,
+) (resolver.Resolver, error) {
+	r := &Resolver{clientConn: cc}
+	var dialOpts []grpc.DialOption
+	if opts.DialCreds != nil {
+		dialOpts = append(
+			dialOpts,
+			grpc.WithTransportCredentials(opts.DialCreds),
+		)
+	} else {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
+	}
+	r.serviceConfig = cc.ParseServiceConfig(
+		fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
+	)
+	var err error
+	r.resolverConn, err = grpc.Dial(target.Endpoint, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	return r, nil
+}
+
+func (r *Resolver) Scheme() string {
+	return Name
+}
+
+var _ resolver.Resolver = (*Resolver)(nil)
+
+// ResolveNow fetches the cluster's servers and updates the client's
+// addresses, reporting the error to gRPC when the server can't be reached.
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client := api.NewLogClient(r.resolverConn)
+	ctx := context.Background()
+	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+	if err != nil {
+		log.Printf("[ERROR] loadbalance: failed to resolve servers: %v", err)
+		r.clientConn.ReportError(err)
+		return
+	}
+	var addrs []resolver.Address
+	for _, server := range res.Servers {
+		addrs = append(addrs, resolver.Address{
+			Addr: server.RpcAddr,
+			Attributes: attributes.New(
+				isLeaderKey{},
+				server.IsLeader,
+			),
+		})
+	}
+	r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	})
+}
+
+func (r *Resolver) Close() {
+	if err := r.resolverConn.Close(); err != nil {
+		log.Printf("[ERROR] loadbalance: failed to close conn: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package loadbalance
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+	"github.com/Franklynoble/proglog/internal/auth"
+	"github.com/Franklynoble/proglog/internal/config"
+	"github.com/Franklynoble/proglog/internal/log"
+	"github.com/Franklynoble/proglog/internal/server"
+)
+
+// TestResolver checks the resolver turns the servers a server returns from
+// GetServers into the client's addresses.
+func TestResolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.ServerCertFile,
+		KeyFile:  config.ServerKeyFile,
+		CAFile:   config.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	serverCreds := credentials.NewTLS(tlsConfig)
+
+	dir, err := ioutil.TempDir("", "resolver-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	srv, err := server.NEWGRPCServer(&server.Config{
+		CommitLog:  clog,
+		Authorizer: auth.New(config.ACLModelFile, config.ACLPolicyFile),
+		Servers: []*api.Server{
+			{Id: "leader", RpcAddr: "localhost:9001", IsLeader: true},
+			{Id: "follower", RpcAddr: "localhost:9002"},
+		},
+	}, grpc.Creds(serverCreds))
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	conn := &clientConn{}
+	tlsConfig, err = config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.RootClientCertFile,
+		KeyFile:  config.RootClientKeyFile,
+		CAFile:   config.CAFile,
+		Server:   false,
+	})
+	require.NoError(t, err)
+	opts := resolver.BuildOptions{
+		DialCreds: credentials.NewTLS(tlsConfig),
+	}
+	r := &Resolver{}
+	rr, err := r.Build(
+		resolver.Target{Endpoint: l.Addr().String()},
+		conn,
+		opts,
+	)
+	require.NoError(t, err)
+	defer rr.Close()
+
+	wantState := resolver.State{
+		Addresses: []resolver.Address{{
+			Addr:       "localhost:9001",
+			Attributes: attributes.New(isLeaderKey{}, true),
+		}, {
+			Addr:       "localhost:9002",
+			Attributes: attributes.New(isLeaderKey{}, false),
+		}},
+	}
+	require.Equal(t, wantState.Addresses, conn.state.Addresses)
+	require.Nil(t, conn.err)
+}
+
+type clientConn struct {
+	resolver.ClientConn
+	state resolver.State
+	err   error
+}
+
+func (c *clientConn) UpdateState(state resolver.State) {
+	c.state = state
+}
+
+func (c *clientConn) ReportError(err error) {
+	c.err = err
+}
+
+func (c *clientConn) NewAddress(addrs []resolver.Address) {}
+
+func (c *clientConn) NewServiceConfig(config string) {}
+
+func (c *clientConn) ParseServiceConfig(
+	config string,
+) *serviceconfig.ParseResult {
+	return nil
+}
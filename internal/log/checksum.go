@@ -0,0 +1,125 @@
+package log
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+)
+
+// hashChunk is how much of a store the checksums read at a time.
+const hashChunk = 64 * 1024
+
+/*
+Checksums returns a checksum for each of the log's segments. Each segment
+keeps a rolling SHA-256 of its store's contents that catches up with the
+records appended since the last call, so checking a log regularly only reads
+what's new.
+
+The checksums hash the records as the stores hold them, timestamps, producers
+and sequences included, so two logs only compare equal when one holds
+verbatim copies of the other's records, the way Replicate stores them. Logs
+that appended the same values on their own don't.
+*/
+func (l *Log) Checksums() ([]*api.Checksum, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	checksums := make([]*api.Checksum, 0, len(l.segments))
+	for _, s := range l.segments {
+		sum, err := s.checksum()
+		if err != nil {
+			return nil, err
+		}
+		checksums = append(checksums, &api.Checksum{
+			StartOffset: s.baseOffset,
+			EndOffset:   s.nextOffset,
+			Hash:        sum,
+		})
+	}
+	return checksums, nil
+}
+
+// Checksum returns the SHA-256 of the records from start up to but not
+// including end as the stores hold them. A segment's range has the same
+// checksum as the segment, whatever segments the records span.
+func (l *Log) Checksum(start, end uint64) ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if end < start {
+		return nil, api.ErrOffsetOutOfRange{Offset: end}
+	}
+	h := sha256.New()
+	off := start
+	for _, s := range l.segments {
+		if off == end {
+			break
+		}
+		if off < s.baseOffset || off >= s.nextOffset {
+			continue
+		}
+		last := end
+		if last > s.nextOffset {
+			last = s.nextOffset
+		}
+		from, err := s.position(off)
+		if err != nil {
+			return nil, err
+		}
+		to, err := s.position(last)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.hashStore(h, from, to); err != nil {
+			return nil, err
+		}
+		off = last
+	}
+	if off != end {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return h.Sum(nil), nil
+}
+
+// checksum returns the hash of the segment's whole store.
+func (s *segment) checksum() ([]byte, error) {
+	s.hashMu.Lock()
+	defer s.hashMu.Unlock()
+	if s.hash == nil {
+		s.hash = sha256.New()
+		s.hashed = 0
+	}
+	if err := s.hashStore(s.hash, s.hashed, s.store.size); err != nil {
+		return nil, err
+	}
+	s.hashed = s.store.size
+	return s.hash.Sum(nil), nil
+}
+
+// position returns where the record at off starts in the store, or where the
+// next record will go for the segment's next offset.
+func (s *segment) position(off uint64) (uint64, error) {
+	if off == s.nextOffset {
+		return s.store.size, nil
+	}
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	return pos, err
+}
+
+// hashStore writes the store's bytes from position from up to to into h.
+func (s *segment) hashStore(h hash.Hash, from, to uint64) error {
+	b := make([]byte, hashChunk)
+	for from < to {
+		n := to - from
+		if n > hashChunk {
+			n = hashChunk
+		}
+		read, err := s.store.ReadAt(b[:n], int64(from))
+		if err != nil && !(err == io.EOF && uint64(read) == n) {
+			return err
+		}
+		h.Write(b[:read])
+		from += uint64(read)
+	}
+	return nil
+}
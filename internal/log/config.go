@@ -1,9 +1,27 @@
 package log
 
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
 type Config struct {
+	Raft struct {
+		raft.Config
+		StreamLayer *StreamLayer
+		Bootstrap   bool
+	}
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
 	}
+	// Durability.SyncInterval is how often the log syncs its records to
+	// stable storage, advances its watermark and checkpoints it. 0 syncs
+	// every append's records before the append returns, checkpointing the
+	// watermark only on Sync and Close.
+	Durability struct {
+		SyncInterval time.Duration
+	}
 }
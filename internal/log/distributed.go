@@ -0,0 +1,663 @@
+package log
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+)
+
+/*
+DistributedLog replicates the log across a cluster with Raft. Writes go
+through the Raft leader and are only acknowledged once a quorum of the
+cluster has committed them; every server then applies them to its own Log,
+the Raft finite-state machine. Reads are served from the local Log.
+*/
+type DistributedLog struct {
+	config Config
+	log    *Log
+	raft   *raft.Raft
+}
+
+func NewDistributedLog(dataDir string, config Config) (
+	*DistributedLog,
+	error,
+) {
+	l := &DistributedLog{
+		config: config,
+	}
+	if err := l.setupLog(dataDir); err != nil {
+		return nil, err
+	}
+	if err := l.setupRaft(dataDir); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *DistributedLog) setupLog(dataDir string) error {
+	logDir := filepath.Join(dataDir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	var err error
+	l.log, err = NewLog(logDir, l.config)
+	return err
+}
+
+/*
+setupRaft creates the Raft instance: the finite-state machine applying the
+commands, a log store for the Raft log entries built on our Log, a stable
+store for the cluster's configuration and current term, a snapshot store and
+a transport over the StreamLayer to reach the other servers.
+*/
+func (l *DistributedLog) setupRaft(dataDir string) error {
+	fsm := &fsm{log: l.log}
+
+	logDir := filepath.Join(dataDir, "raft", "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	logConfig := l.config
+	// Raft log indexes start at 1
+	logConfig.Segment.InitialOffset = 1
+	logStore, err := newLogStore(logDir, logConfig)
+	if err != nil {
+		return err
+	}
+
+	stableStore, err := newStableStore(
+		filepath.Join(dataDir, "raft", "stable"),
+	)
+	if err != nil {
+		return err
+	}
+
+	retain := 1
+	snapshotStore, err := raft.NewFileSnapshotStore(
+		filepath.Join(dataDir, "raft"),
+		retain,
+		os.Stderr,
+	)
+	if err != nil {
+		return err
+	}
+
+	maxPool := 5
+	timeout := 10 * time.Second
+	transport := raft.NewNetworkTransport(
+		l.config.Raft.StreamLayer,
+		maxPool,
+		timeout,
+		os.Stderr,
+	)
+
+	config := raft.DefaultConfig()
+	config.LocalID = l.config.Raft.LocalID
+	if l.config.Raft.HeartbeatTimeout != 0 {
+		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
+	}
+	if l.config.Raft.ElectionTimeout != 0 {
+		config.ElectionTimeout = l.config.Raft.ElectionTimeout
+	}
+	if l.config.Raft.LeaderLeaseTimeout != 0 {
+		config.LeaderLeaseTimeout = l.config.Raft.LeaderLeaseTimeout
+	}
+	if l.config.Raft.CommitTimeout != 0 {
+		config.CommitTimeout = l.config.Raft.CommitTimeout
+	}
+
+	l.raft, err = raft.NewRaft(
+		config,
+		fsm,
+		logStore,
+		stableStore,
+		snapshotStore,
+		transport,
+	)
+	if err != nil {
+		return err
+	}
+	hasState, err := raft.HasExistingState(
+		logStore,
+		stableStore,
+		snapshotStore,
+	)
+	if err != nil {
+		return err
+	}
+	if l.config.Raft.Bootstrap && !hasState {
+		config := raft.Configuration{
+			Servers: []raft.Server{{
+				ID:      config.LocalID,
+				Address: transport.LocalAddr(),
+			}},
+		}
+		err = l.raft.BootstrapCluster(config).Error()
+	}
+	return err
+}
+
+// Append appends the record to the log once the cluster commits it.
+func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	return l.appendRecord(&api.ProduceRequest{Record: record})
+}
+
+// AppendIf appends the record if the log's next offset is expectedNext once
+// the cluster commits it.
+func (l *DistributedLog) AppendIf(
+	record *api.Record,
+	expectedNext uint64,
+) (uint64, error) {
+	return l.appendRecord(&api.ProduceRequest{
+		Record:         record,
+		ExpectedOffset: &expectedNext,
+	})
+}
+
+func (l *DistributedLog) appendRecord(req *api.ProduceRequest) (uint64, error) {
+	// stamp the record before replicating it so every server stores the
+	// same time
+	if req.Record.Timestamp == 0 {
+		req.Record.Timestamp = time.Now().UnixNano()
+	}
+	res, err := l.apply(AppendRequestType, req)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ProduceResponse).Offset, nil
+}
+
+func (l *DistributedLog) BeginTransaction() (uint64, error) {
+	res, err := l.apply(
+		BeginTransactionRequestType,
+		&api.BeginTransactionRequest{},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.BeginTransactionResponse).TransactionId, nil
+}
+
+func (l *DistributedLog) CommitTransaction(id uint64) (uint64, error) {
+	return l.endTransaction(CommitTransactionRequestType, id)
+}
+
+func (l *DistributedLog) AbortTransaction(id uint64) (uint64, error) {
+	return l.endTransaction(AbortTransactionRequestType, id)
+}
+
+func (l *DistributedLog) endTransaction(
+	reqType RequestType,
+	id uint64,
+) (uint64, error) {
+	res, err := l.apply(
+		reqType,
+		&api.EndTransactionRequest{TransactionId: id},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.EndTransactionResponse).Offset, nil
+}
+
+func (l *DistributedLog) CommitOffset(
+	group string,
+	partition uint32,
+	offset uint64,
+) error {
+	_, err := l.apply(CommitOffsetRequestType, &api.CommitOffsetRequest{
+		Group:     group,
+		Partition: partition,
+		Offset:    offset,
+	})
+	return err
+}
+
+/*
+apply wraps the request in a command the finite-state machine understands,
+the request type followed by the marshaled request, and replicates it with
+Raft. It returns what the finite-state machine returned for the command once
+the cluster committed it and the local server applied it.
+*/
+func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
+	interface{},
+	error,
+) {
+	var buf bytes.Buffer
+	_, err := buf.Write([]byte{byte(reqType)})
+	if err != nil {
+		return nil, err
+	}
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	_, err = buf.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	timeout := 10 * time.Second
+	future := l.raft.Apply(buf.Bytes(), timeout)
+	if future.Error() != nil {
+		return nil, future.Error()
+	}
+	res := future.Response()
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Read reads the record from the local log, so it may lag behind the leader.
+func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
+	return l.log.Read(offset)
+}
+
+// LowestOffset returns the local log's lowest offset.
+func (l *DistributedLog) LowestOffset() (uint64, error) {
+	return l.log.LowestOffset()
+}
+
+// HighestOffset returns the local log's highest offset.
+func (l *DistributedLog) HighestOffset() (uint64, error) {
+	return l.log.HighestOffset()
+}
+
+// Watermark returns the local log's durable watermark.
+func (l *DistributedLog) Watermark() uint64 {
+	return l.log.Watermark()
+}
+
+// Checksums returns the local log's segment checksums.
+func (l *DistributedLog) Checksums() ([]*api.Checksum, error) {
+	return l.log.Checksums()
+}
+
+// Checksum returns the checksum of the local log's records from start up to
+// but not including end.
+func (l *DistributedLog) Checksum(start, end uint64) ([]byte, error) {
+	return l.log.Checksum(start, end)
+}
+
+func (l *DistributedLog) TransactionState(id uint64) TransactionState {
+	return l.log.TransactionState(id)
+}
+
+func (l *DistributedLog) ExpiredTransactions(timeout time.Duration) []uint64 {
+	return l.log.ExpiredTransactions(timeout)
+}
+
+func (l *DistributedLog) FetchOffset(group string, partition uint32) (uint64, error) {
+	return l.log.FetchOffset(group, partition)
+}
+
+// Join adds the server to the cluster as a voter.
+func (l *DistributedLog) Join(id, addr string) error {
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	serverID := raft.ServerID(id)
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == serverID || srv.Address == serverAddr {
+			if srv.ID == serverID && srv.Address == serverAddr {
+				// server has already joined
+				return nil
+			}
+			// remove the existing server
+			removeFuture := l.raft.RemoveServer(serverID, 0, 0)
+			if err := removeFuture.Error(); err != nil {
+				return err
+			}
+		}
+	}
+	addFuture := l.raft.AddVoter(serverID, serverAddr, 0, 0)
+	if err := addFuture.Error(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Leave removes the server from the cluster.
+func (l *DistributedLog) Leave(id string) error {
+	removeFuture := l.raft.RemoveServer(raft.ServerID(id), 0, 0)
+	return removeFuture.Error()
+}
+
+// WaitForLeader blocks until the cluster has elected a leader or times out.
+func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out")
+		case <-ticker.C:
+			if l := l.raft.Leader(); l != "" {
+				return nil
+			}
+		}
+	}
+}
+
+// Close shuts down the Raft instance and closes the local log.
+func (l *DistributedLog) Close() error {
+	// the local log closes even when raft fails to shut down
+	err := l.raft.Shutdown().Error()
+	if cerr := l.log.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+var _ raft.FSM = (*fsm)(nil)
+
+type fsm struct {
+	log *Log
+}
+
+type RequestType uint8
+
+const (
+	AppendRequestType RequestType = iota
+	BeginTransactionRequestType
+	CommitTransactionRequestType
+	AbortTransactionRequestType
+	CommitOffsetRequestType
+)
+
+// Apply runs a command the cluster committed against the local log. Errors
+// are returned as the command's response so the caller of apply gets them.
+func (f *fsm) Apply(record *raft.Log) interface{} {
+	buf := record.Data
+	reqType := RequestType(buf[0])
+	switch reqType {
+	case AppendRequestType:
+		return f.applyAppend(buf[1:])
+	case BeginTransactionRequestType:
+		id, err := f.log.BeginTransaction()
+		if err != nil {
+			return err
+		}
+		return &api.BeginTransactionResponse{TransactionId: id}
+	case CommitTransactionRequestType:
+		return f.applyEndTransaction(buf[1:], f.log.CommitTransaction)
+	case AbortTransactionRequestType:
+		return f.applyEndTransaction(buf[1:], f.log.AbortTransaction)
+	case CommitOffsetRequestType:
+		return f.applyCommitOffset(buf[1:])
+	}
+	return nil
+}
+
+func (f *fsm) applyAppend(b []byte) interface{} {
+	var req api.ProduceRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	var offset uint64
+	var err error
+	if req.ExpectedOffset != nil {
+		offset, err = f.log.AppendIf(req.Record, *req.ExpectedOffset)
+	} else {
+		offset, err = f.log.Append(req.Record)
+	}
+	if err != nil {
+		return err
+	}
+	return &api.ProduceResponse{Offset: offset}
+}
+
+func (f *fsm) applyEndTransaction(
+	b []byte,
+	end func(uint64) (uint64, error),
+) interface{} {
+	var req api.EndTransactionRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	offset, err := end(req.TransactionId)
+	if err != nil {
+		return err
+	}
+	return &api.EndTransactionResponse{Offset: offset}
+}
+
+func (f *fsm) applyCommitOffset(b []byte) interface{} {
+	var req api.CommitOffsetRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	if err := f.log.CommitOffset(req.Group, req.Partition, req.Offset); err != nil {
+		return err
+	}
+	return &api.CommitOffsetResponse{}
+}
+
+/*
+Snapshot returns a point-in-time snapshot of the finite-state machine's state:
+the groups' committed offsets, length-prefixed, followed by the log's records
+as they're stored on disk.
+*/
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	offsets, err := f.log.groups.marshal()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, lenWidth)
+	enc.PutUint64(header, uint64(len(offsets)))
+	r := io.MultiReader(
+		bytes.NewReader(header),
+		bytes.NewReader(offsets),
+		f.log.Reader(),
+	)
+	return &snapshot{reader: r}, nil
+}
+
+var _ raft.FSMSnapshot = (*snapshot)(nil)
+
+type snapshot struct {
+	reader io.Reader
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := io.Copy(sink, s.reader); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
+
+// Restore replaces the local log with the snapshot's offsets and records.
+func (f *fsm) Restore(r io.ReadCloser) error {
+	b := make([]byte, lenWidth)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	offsets := make([]byte, enc.Uint64(b))
+	if _, err := io.ReadFull(r, offsets); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	reset := false
+	for {
+		_, err := io.ReadFull(r, b)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		size := int64(enc.Uint64(b))
+		if _, err = io.CopyN(&buf, r, size); err != nil {
+			return err
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
+			return err
+		}
+		if !reset {
+			f.log.Config.Segment.InitialOffset = record.Offset
+			if err := f.log.Reset(); err != nil {
+				return err
+			}
+			reset = true
+		}
+		if _, err = f.log.Replicate(record); err != nil {
+			return err
+		}
+		buf.Reset()
+	}
+	if !reset {
+		if err := f.log.Reset(); err != nil {
+			return err
+		}
+	}
+	return f.log.groups.restore(offsets)
+}
+
+var _ raft.LogStore = (*logStore)(nil)
+
+// logStore stores the Raft log entries as records in a Log.
+type logStore struct {
+	*Log
+}
+
+func newLogStore(dir string, c Config) (*logStore, error) {
+	log, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	return &logStore{log}, nil
+}
+
+func (l *logStore) FirstIndex() (uint64, error) {
+	return l.LowestOffset()
+}
+
+func (l *logStore) LastIndex() (uint64, error) {
+	off, err := l.HighestOffset()
+	return off, err
+}
+
+func (l *logStore) GetLog(index uint64, out *raft.Log) error {
+	in, err := l.Read(index)
+	if err != nil {
+		return err
+	}
+	out.Data = in.Value
+	out.Index = in.Offset
+	out.Type = raft.LogType(in.Type)
+	out.Term = in.Term
+	return nil
+}
+
+func (l *logStore) StoreLog(record *raft.Log) error {
+	return l.StoreLogs([]*raft.Log{record})
+}
+
+func (l *logStore) StoreLogs(records []*raft.Log) error {
+	for _, record := range records {
+		if _, err := l.Append(&api.Record{
+			Value: record.Data,
+			Term:  record.Term,
+			Type:  uint32(record.Type),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRange removes the entries up to max, which Raft has compacted into a
+// snapshot.
+func (l *logStore) DeleteRange(min, max uint64) error {
+	return l.Truncate(max)
+}
+
+var _ raft.StreamLayer = (*StreamLayer)(nil)
+
+/*
+StreamLayer is the Raft transport's connection layer. Raft connections start
+with the RaftRPC byte so they can share a listener with other protocols, and
+are encrypted with TLS when the StreamLayer has TLS configs.
+*/
+type StreamLayer struct {
+	ln              net.Listener
+	serverTLSConfig *tls.Config
+	peerTLSConfig   *tls.Config
+}
+
+func NewStreamLayer(
+	ln net.Listener,
+	serverTLSConfig,
+	peerTLSConfig *tls.Config,
+) *StreamLayer {
+	return &StreamLayer{
+		ln:              ln,
+		serverTLSConfig: serverTLSConfig,
+		peerTLSConfig:   peerTLSConfig,
+	}
+}
+
+const RaftRPC = 1
+
+func (s *StreamLayer) Dial(
+	addr raft.ServerAddress,
+	timeout time.Duration,
+) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn, err = dialer.Dial("tcp", string(addr))
+	if err != nil {
+		return nil, err
+	}
+	// identify to mux this is a raft rpc
+	_, err = conn.Write([]byte{byte(RaftRPC)})
+	if err != nil {
+		return nil, err
+	}
+	if s.peerTLSConfig != nil {
+		conn = tls.Client(conn, s.peerTLSConfig)
+	}
+	return conn, err
+}
+
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 1)
+	_, err = conn.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal([]byte{byte(RaftRPC)}, b) {
+		return nil, fmt.Errorf("not a raft rpc")
+	}
+	if s.serverTLSConfig != nil {
+		return tls.Server(conn, s.serverTLSConfig), nil
+	}
+	return conn, nil
+}
+
+func (s *StreamLayer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *StreamLayer) Addr() net.Addr {
+	return s.ln.Addr()
+}
@@ -0,0 +1,163 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+)
+
+/*
+TestMultipleNodes runs a three server cluster over loopback, checks the
+records appended to the leader get replicated to every server, and that a
+server that left the cluster stops getting them.
+*/
+func TestMultipleNodes(t *testing.T) {
+	var logs []*DistributedLog
+	nodeCount := 3
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := ioutil.TempDir("", "distributed-log-test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+
+		if i == 0 {
+			config.Raft.Bootstrap = true
+		}
+
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer l.Close()
+
+		if i != 0 {
+			err = logs[0].Join(
+				fmt.Sprintf("%d", i), ln.Addr().String(),
+			)
+			require.NoError(t, err)
+		} else {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+			// the leader was elected, the log can serve
+			require.NoError(t, l.Health())
+		}
+
+		logs = append(logs, l)
+	}
+
+	records := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	}
+	for _, record := range records {
+		off, err := logs[0].Append(record)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			for j := 0; j < nodeCount; j++ {
+				got, err := logs[j].Read(off)
+				if err != nil {
+					return false
+				}
+				if !bytes.Equal(got.Value, record.Value) {
+					return false
+				}
+			}
+			return true
+		}, 500*time.Millisecond, 50*time.Millisecond)
+	}
+
+	// the cluster agrees on the log's next offset
+	_, err := logs[0].AppendIf(&api.Record{Value: []byte("stale")}, 0)
+	require.Equal(t, api.ErrOffsetConflict{Expected: 0, Next: 2}, err)
+
+	err = logs[0].Leave("1")
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+
+	off, err := logs[0].Append(&api.Record{
+		Value: []byte("third"),
+	})
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+
+	record, err := logs[1].Read(off)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	require.Nil(t, record)
+
+	record, err = logs[2].Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("third"), record.Value)
+	require.Equal(t, off, record.Offset)
+}
+
+// tests that restoring a snapshot brings back the records and the groups'
+// committed offsets
+func TestSnapshotRestore(t *testing.T) {
+	newLog := func() *Log {
+		dir, err := ioutil.TempDir("", "snapshot-test")
+		require.NoError(t, err)
+		l, err := NewLog(dir, Config{})
+		require.NoError(t, err)
+		return l
+	}
+	src := newLog()
+	defer src.Remove()
+	dst := newLog()
+	defer dst.Remove()
+
+	for i := 0; i < 3; i++ {
+		_, err := src.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, src.CommitOffset("group", 0, 2))
+	_, err := dst.Append(&api.Record{Value: []byte("stale")})
+	require.NoError(t, err)
+
+	snap, err := (&fsm{log: src}).Snapshot()
+	require.NoError(t, err)
+	sink := &bufferSink{}
+	require.NoError(t, snap.Persist(sink))
+
+	err = (&fsm{log: dst}).Restore(ioutil.NopCloser(&sink.Buffer))
+	require.NoError(t, err)
+
+	off, err := dst.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	record, err := dst.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	off, err = dst.FetchOffset("group", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (s *bufferSink) ID() string    { return "buffer" }
+func (s *bufferSink) Cancel() error { return nil }
+func (s *bufferSink) Close() error  { return nil }
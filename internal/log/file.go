@@ -0,0 +1,43 @@
+package log
+
+import (
+	"os"
+	"path"
+)
+
+/*
+WriteFileAtomic durably replaces the named file with b: it writes b to a
+temporary file, syncs it, renames it over the file and syncs the directory so
+the rename survives a crash too. A crash leaves either the old or the new
+contents on disk but never a torn write.
+*/
+func WriteFileAtomic(name string, b []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		return err
+	}
+	dir, err := os.Open(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	if err = dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
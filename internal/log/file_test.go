@@ -0,0 +1,28 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write_file_atomic_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := path.Join(dir, "file")
+	for _, want := range []string{"old", "new"} {
+		require.NoError(t, WriteFileAtomic(name, []byte(want)))
+		got, err := ioutil.ReadFile(name)
+		require.NoError(t, err)
+		require.Equal(t, want, string(got))
+	}
+
+	// the temporary file is renamed away
+	_, err = os.Stat(name + ".tmp")
+	require.True(t, os.IsNotExist(err))
+}
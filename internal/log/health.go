@@ -0,0 +1,52 @@
+package log
+
+import (
+	"errors"
+	"syscall"
+)
+
+// The reasons Health gives for a log that can't serve.
+var (
+	ErrNotReady = errors.New("the log isn't set up")
+	ErrDiskFull = errors.New("the log's disk is full")
+	ErrNoLeader = errors.New("the cluster has no leader")
+)
+
+/*
+Health returns why the log can't serve, or nil when it can: the log isn't set
+up until NewLog has loaded its segments and isn't once it's closed, and its
+disk is full when it has no room for another segment, so appends would fail
+once the active segment is.
+*/
+func (l *Log) Health() error {
+	l.mu.RLock()
+	ready := l.ready
+	l.mu.RUnlock()
+	if !ready {
+		return ErrNotReady
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(l.Dir, &fs); err != nil {
+		return err
+	}
+	free := uint64(fs.Bavail) * uint64(fs.Bsize)
+	if free < l.Config.Segment.MaxStoreBytes+l.Config.Segment.MaxIndexBytes {
+		return ErrDiskFull
+	}
+	return nil
+}
+
+// Health returns why the log can't serve, or nil when it can: on top of the
+// local log's health, the cluster must have a leader to take writes.
+func (l *DistributedLog) Health() error {
+	if l.log == nil || l.raft == nil {
+		return ErrNotReady
+	}
+	if err := l.log.Health(); err != nil {
+		return err
+	}
+	if l.raft.Leader() == "" {
+		return ErrNoLeader
+	}
+	return nil
+}
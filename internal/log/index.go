@@ -54,6 +54,27 @@ func newIndex(f *os.File, c Config) (*index, error) {
 
 }
 
+// Truncate keeps the index's first n entries, zeroing the rest; Close
+// truncates the file to them.
+func (i *index) Truncate(n uint64) {
+	if n*entWidth >= i.size {
+		return
+	}
+	for b := n * entWidth; b < i.size; b++ {
+		i.mmap[b] = 0
+	}
+	i.size = n * entWidth
+}
+
+// Sync flushes the memory-mapped entries and commits the file to stable
+// storage.
+func (i *index) Sync() error {
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	return i.file.Sync()
+}
+
 func (i *index) Close() error {
 	/*
 		Sync flushes changes made to the region determined by
@@ -120,6 +141,7 @@ func (i *index) Write(off uint32, pos uint64) error {
 	}
 	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
 	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
+	i.size += uint64(entWidth)
 	return nil
 }
 
@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/Franklynoble/proglog/api/v1"
 )
@@ -280,6 +281,25 @@ type Log struct {
 
 	activeSegment *segment
 	segments      []*segment
+	producers     map[string]producerState
+
+	transactions    map[uint64]TransactionState
+	nextTransaction uint64
+	// transactionBegins holds the open transactions' BEGIN timestamps
+	transactionBegins map[uint64]int64
+
+	groups *groupOffsets
+
+	// watermark is the offset below which every record is durable, and
+	// checkpointed the watermark the checkpoint file last recorded
+	watermark     uint64
+	checkpointed  uint64
+	syncerDone    chan struct{}
+	syncerStopped chan struct{}
+
+	// ready is set once setup has loaded the log and cleared when it's
+	// closed
+	ready bool
 }
 
 // END: begin
@@ -310,6 +330,11 @@ func (l *Log) setup() error {
 	}
 	var baseOffsets []uint64
 	for _, file := range files {
+		// the dir also holds files that aren't segments, like the
+		// groups' committed offsets
+		if ext := path.Ext(file.Name()); ext != ".store" && ext != ".index" {
+			continue
+		}
 		offStr := strings.TrimSuffix(
 			file.Name(),
 			path.Ext(file.Name()),
@@ -333,25 +358,127 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
+	if l.groups, err = newGroupOffsets(l.Dir); err != nil {
+		return err
+	}
+	if err = l.loadState(); err != nil {
+		return err
+	}
+	if err = l.loadWatermark(); err != nil {
+		return err
+	}
+	if interval := l.Config.Durability.SyncInterval; interval > 0 {
+		l.startSyncer(interval)
+	}
+	l.mu.Lock()
+	l.ready = true
+	l.mu.Unlock()
 	return nil
 }
 
 // END: setup
 
 // START: append
+// Append appends the record to the active segment. A record carrying a
+// producer ID and a sequence the producer already appended isn't written
+// again; Append returns the offset it was first stored under instead.
 func (l *Log) Append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if off, ok, err := l.dedup(record); ok || err != nil {
+		return off, err
+	}
+	if err := l.checkTransaction(record); err != nil {
+		return 0, err
+	}
+	return l.append(record)
+}
+
+// AppendIf appends the record only if the log would store it under the
+// expectedNext offset, so writers can append optimistically on top of the
+// state they last read.
+func (l *Log) AppendIf(record *api.Record, expectedNext uint64) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if off, ok, err := l.dedup(record); ok || err != nil {
+		return off, err
+	}
+	if next := l.activeSegment.nextOffset; next != expectedNext {
+		return 0, api.ErrOffsetConflict{Expected: expectedNext, Next: next}
+	}
+	if err := l.checkTransaction(record); err != nil {
+		return 0, err
+	}
+	return l.append(record)
+}
+
+/*
+Replicate appends a record another log already accepted, verbatim: it keeps
+the record's producer, sequence, transaction and timestamp and skips the
+producer and transaction checks Append makes, so the copy checksums the same
+as its source. The log stores the record under its next offset; callers
+copying a log's suffix, rather than several logs into one, check that's the
+offset the record carries.
+*/
+func (l *Log) Replicate(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.append(record)
+}
+
+// append writes the record and rolls the active segment over once it's
+// maxed. Records that don't carry a timestamp yet are stamped with the time
+// they're appended, and without a sync interval every record is synced before
+// append returns. A closed log fails the append with ErrNotReady, so writers
+// still running when it's closed don't write to its closed segments. Callers
+// hold the write lock.
+func (l *Log) append(record *api.Record) (uint64, error) {
+	if !l.ready {
+		return 0, ErrNotReady
+	}
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
 		return 0, err
 	}
+	l.track(record)
+	if l.Config.Durability.SyncInterval == 0 {
+		if err = l.flush(); err != nil {
+			return 0, err
+		}
+	}
 	if l.activeSegment.IsMaxed() {
 		err = l.newSegment(off + 1)
 	}
 	return off, err
 }
 
+// loadState replays the segments to rebuild the producer sequences and
+// transaction states the records carry.
+func (l *Log) loadState() error {
+	l.producers = make(map[string]producerState)
+	l.transactions = make(map[uint64]TransactionState)
+	l.transactionBegins = make(map[uint64]int64)
+	l.nextTransaction = 1
+	for _, s := range l.segments {
+		for off := s.baseOffset; off < s.nextOffset; off++ {
+			record, err := s.Read(off)
+			if err != nil {
+				return err
+			}
+			l.track(record)
+		}
+	}
+	return nil
+}
+
+func (l *Log) track(record *api.Record) {
+	l.trackProducer(record)
+	l.trackTransaction(record)
+}
+
 // END: append
 
 // START: read
@@ -389,9 +516,16 @@ func (l *Log) newSegment(off uint64) error {
 // END: newsegment
 
 // START: close
+// Close syncs the log, advancing the watermark past every record, and closes
+// the segments.
 func (l *Log) Close() error {
+	l.stopSyncer()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	l.ready = false
+	if err := l.sync(); err != nil {
+		return err
+	}
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return err
@@ -411,6 +545,10 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	l.segments = nil
 	return l.setup()
 }
 
@@ -453,6 +591,52 @@ func (l *Log) Truncate(lowest uint64) error {
 	return nil
 }
 
+/*
+TruncateFrom removes the records from offset off on, the opposite end of the
+log from Truncate, so a log that diverged from its replicas can be cut back to
+the records they agree on. The watermark moves back with the log and the
+producer and transaction state is rebuilt from the records that are left.
+*/
+func (l *Log) TruncateFrom(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if off < l.segments[0].baseOffset {
+		return api.ErrOffsetOutOfRange{Offset: off}
+	}
+	var segments []*segment
+	for _, s := range l.segments {
+		if s.baseOffset >= off && len(segments) > 0 {
+			if err := s.Remove(); err != nil {
+				return err
+			}
+			continue
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	l.activeSegment = segments[len(segments)-1]
+	if err := l.activeSegment.Truncate(off); err != nil {
+		return err
+	}
+	if err := l.activeSegment.Sync(); err != nil {
+		return err
+	}
+	if l.activeSegment.IsMaxed() {
+		// cutting at a segment's base offset leaves the maxed segment
+		// before it active
+		if err := l.newSegment(off); err != nil {
+			return err
+		}
+	}
+	if next := l.activeSegment.nextOffset; l.watermark > next {
+		if err := l.writeCheckpoint(next); err != nil {
+			return err
+		}
+		l.watermark = next
+	}
+	return l.loadState()
+}
+
 // END: truncate
 
 // START: reader
@@ -466,13 +650,15 @@ func (l *Log) Reader() io.Reader {
 	return io.MultiReader(readers...)
 }
 
+// originReader doesn't embed the store: that would promote the file's WriteTo,
+// which io.Copy prefers and which reads from the file's position instead.
 type originReader struct {
-	*store
-	off int64
+	store *store
+	off   int64
 }
 
 func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
+	n, err := o.store.ReadAt(p, o.off)
 	o.off += int64(n)
 	return n, err
 }
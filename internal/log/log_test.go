@@ -3,7 +3,9 @@ package log
 import (
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
@@ -20,6 +22,16 @@ func TestLog(t *testing.T) {
 		"init with Existing segments":        testInitExisting,
 		"reader":                             testReader,
 		"truncate":                           testTruncate,
+		"truncate from an offset":            testTruncateFrom,
+		"truncate from a segment's base":     testTruncateFromBase,
+		"duplicate sequence is not appended": testIdempotentAppend,
+		"transactions":                       testTransactions,
+		"conditional append":                 testAppendIf,
+		"group offsets":                      testGroupOffsets,
+		"group offsets of the old format":    testGroupOffsetsOldFormat,
+		"durable watermark":                  testWatermark,
+		"checksums":                          testChecksums,
+		"health":                             testHealth,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -55,7 +67,6 @@ func testAppendRead(t *testing.T, log *Log) {
 /*
 tests that the log returns an error when we
 try to read an offset that’s outside of the range of offsets the log has stored
-
 */
 func testOutOfRangeErr(t *testing.T, log *Log) {
 	read, err := log.Read(1)
@@ -70,7 +81,7 @@ func testInitExisting(t *testing.T, o *Log) {
 	append := &api.Record{
 		Value: []byte("Hello world"),
 	}
-	for i := 3; i < 3; i++ {
+	for i := 0; i < 3; i++ {
 		_, err := o.Append(append)
 		require.NoError(t, err)
 	}
@@ -86,6 +97,9 @@ func testInitExisting(t *testing.T, o *Log) {
 
 	n, err := NewLog(o.Dir, o.Config)
 	require.NoError(t, err)
+
+	off, err = n.LowestOffset()
+	require.NoError(t, err)
 	require.Equal(t, uint64(0), off)
 	off, err = n.HighestOffset()
 
@@ -93,7 +107,7 @@ func testInitExisting(t *testing.T, o *Log) {
 	require.Equal(t, uint64(2), off)
 }
 
-//tests that we can read the full, raw log as it’s stored
+// tests that we can read the full, raw log as it’s stored
 // on disk so that we can snapshot and restore the logs in
 func testReader(t *testing.T, log *Log) {
 	append := &api.Record{
@@ -136,3 +150,333 @@ func testTruncate(t *testing.T, log *Log) {
 	require.Error(t, err)
 
 }
+
+// tests that truncating the log's end drops the records across segments,
+// rewinds the watermark and lets the log append past the cut, also after it's
+// reopened
+func testTruncateFrom(t *testing.T, log *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 2)
+
+	require.NoError(t, log.TruncateFrom(1))
+	_, err := log.Read(1)
+	require.Error(t, err)
+	require.Equal(t, uint64(1), log.Watermark())
+
+	// replicated records are copied verbatim, past the producer checks
+	off, err := log.Replicate(&api.Record{
+		Value:      []byte("replica"),
+		Offset:     1,
+		ProducerId: "producer",
+		Sequence:   7,
+		Timestamp:  1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	read, err := n.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("replica"), read.Value)
+	require.Equal(t, "producer", read.ProducerId)
+	require.Equal(t, uint64(7), read.Sequence)
+	require.Equal(t, int64(1), read.Timestamp)
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+// tests that truncating at a segment's base offset leaves a segment the log
+// can append to, even when the segment before it has a full index
+func testTruncateFromBase(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+	c := log.Config
+	c.Segment.MaxIndexBytes = entWidth
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 2)
+	base := log.segments[2].baseOffset
+	require.True(t, log.segments[1].IsMaxed())
+
+	require.NoError(t, log.TruncateFrom(base))
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, base, off)
+}
+
+// tests that a retried producer sequence returns the original offset, also
+// after the log is reopened
+func testIdempotentAppend(t *testing.T, log *Log) {
+	for i := uint64(0); i < 2; i++ {
+		off, err := log.Append(&api.Record{
+			Value:      []byte("hello world"),
+			ProducerId: "producer",
+			Sequence:   i,
+		})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+
+	off, err := log.Append(&api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: "producer",
+		Sequence:   1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	_, err = log.Append(&api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: "producer",
+		Sequence:   0,
+	})
+	require.Equal(t, api.ErrStaleSequence{
+		ProducerID: "producer",
+		Sequence:   0,
+		Last:       1,
+	}, err)
+
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+
+	off, err = n.Append(&api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: "producer",
+		Sequence:   1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+// tests that transactions can only be appended to while open and that their
+// states survive reopening the log
+func testTransactions(t *testing.T, log *Log) {
+	id, err := log.BeginTransaction()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), id)
+	require.Equal(t, TransactionOpen, log.TransactionState(id))
+
+	_, err = log.Append(&api.Record{
+		Value:         []byte("hello world"),
+		TransactionId: id,
+	})
+	require.NoError(t, err)
+
+	off, err := log.CommitTransaction(id)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.Equal(t, TransactionCommitted, log.TransactionState(id))
+
+	_, err = log.Append(&api.Record{
+		Value:         []byte("hello world"),
+		TransactionId: id,
+	})
+	require.Equal(t, api.ErrTransactionNotOpen{TransactionID: id}, err)
+
+	_, err = log.AbortTransaction(id + 1)
+	require.Equal(t, api.ErrTransactionNotOpen{TransactionID: id + 1}, err)
+
+	aborted, err := log.BeginTransaction()
+	require.NoError(t, err)
+	_, err = log.AbortTransaction(aborted)
+	require.NoError(t, err)
+
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	require.Equal(t, TransactionCommitted, n.TransactionState(id))
+	require.Equal(t, TransactionAborted, n.TransactionState(aborted))
+
+	id, err = n.BeginTransaction()
+	require.NoError(t, err)
+	require.Equal(t, aborted+1, id)
+
+	// only the open transaction expires, and only once it's old enough
+	require.Empty(t, n.ExpiredTransactions(time.Hour))
+	require.Equal(t, []uint64{id}, n.ExpiredTransactions(0))
+	_, err = n.AbortTransaction(id)
+	require.NoError(t, err)
+	require.Empty(t, n.ExpiredTransactions(0))
+}
+
+// tests that a conditional append only succeeds at the log's next offset
+func testAppendIf(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	off, err := log.AppendIf(append, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	_, err = log.AppendIf(append, 0)
+	require.Equal(t, api.ErrOffsetConflict{Expected: 0, Next: 1}, err)
+
+	off, err = log.AppendIf(append, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+// tests that committed group offsets are durable and don't get mistaken for
+// segments when the log is reopened
+func testGroupOffsets(t *testing.T, log *Log) {
+	_, err := log.FetchOffset("group", 0)
+	require.Equal(t, api.ErrGroupOffsetNotFound{Group: "group"}, err)
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.CommitOffset("group", 0, 1))
+	require.NoError(t, log.CommitOffset("group", 3, 7))
+
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+
+	off, err := n.FetchOffset("group", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	off, err = n.FetchOffset("group", 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.Len(t, n.segments, 1)
+}
+
+// tests that a file of one offset per group, from before groups read
+// partitions, loads as the groups' offsets of partition 0
+func testGroupOffsetsOldFormat(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+	require.NoError(t, ioutil.WriteFile(
+		path.Join(log.Dir, offsetsFile),
+		[]byte(`{"group":5}`),
+		0644,
+	))
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+
+	off, err := n.FetchOffset("group", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+
+	// a commit rewrites the file in the current format
+	require.NoError(t, n.CommitOffset("group", 1, 7))
+	require.NoError(t, n.Close())
+	n, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	off, err = n.FetchOffset("group", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	off, err = n.FetchOffset("group", 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+}
+
+func testWatermark(t *testing.T, log *Log) {
+	append := func(l *Log) {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// without a sync interval every append is synced, and the watermark
+	// checkpointed once the log closes
+	append(log)
+	require.Equal(t, uint64(1), log.Watermark())
+	_, err := os.Stat(path.Join(log.Dir, checkpointFile))
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, log.Close())
+	b, err := ioutil.ReadFile(path.Join(log.Dir, checkpointFile))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), enc.Uint64(b))
+
+	c := log.Config
+	c.Durability.SyncInterval = time.Hour
+	n, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), n.Watermark())
+
+	append(n)
+	append(n)
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.Equal(t, uint64(1), n.Watermark())
+
+	require.NoError(t, n.Sync())
+	require.Equal(t, uint64(3), n.Watermark())
+	b, err = ioutil.ReadFile(path.Join(n.Dir, checkpointFile))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), enc.Uint64(b))
+
+	// closing syncs what's left
+	append(n)
+	require.NoError(t, n.Close())
+	n, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer n.Close()
+	require.Equal(t, uint64(4), n.Watermark())
+}
+
+func testChecksums(t *testing.T, log *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	checksums, err := log.Checksums()
+	require.NoError(t, err)
+	require.Len(t, checksums, len(log.segments))
+
+	// a segment's rolling checksum matches the checksum of its range
+	for _, c := range checksums {
+		sum, err := log.Checksum(c.StartOffset, c.EndOffset)
+		require.NoError(t, err)
+		require.Equal(t, c.Hash, sum)
+	}
+
+	whole, err := log.Checksum(0, 5)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	sum, err := log.Checksum(0, 5)
+	require.NoError(t, err)
+	require.Equal(t, whole, sum)
+	sum, err = log.Checksum(0, 6)
+	require.NoError(t, err)
+	require.NotEqual(t, whole, sum)
+
+	_, err = log.Checksum(0, 7)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 6}, err)
+}
+
+func testHealth(t *testing.T, log *Log) {
+	require.NoError(t, log.Health())
+
+	// the disk has no room for segments this big
+	log.Config.Segment.MaxStoreBytes = 1 << 62
+	require.Equal(t, ErrDiskFull, log.Health())
+	log.Config.Segment.MaxStoreBytes = 32
+
+	require.NoError(t, log.Close())
+	require.Equal(t, ErrNotReady, log.Health())
+	// appends racing the close fail rather than write to closed segments
+	_, err := log.Append(&api.Record{Value: []byte("late")})
+	require.Equal(t, ErrNotReady, err)
+	_, err = log.Replicate(&api.Record{Value: []byte("late")})
+	require.Equal(t, ErrNotReady, err)
+}
@@ -0,0 +1,141 @@
+package log
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+)
+
+// offsetsFile is where the log keeps the consumer groups' committed offsets,
+// next to its segments.
+const offsetsFile = "groups.offsets"
+
+/*
+groupOffsets stores the offset each consumer group will consume next from
+each partition it reads; groups whose members don't share the log through the
+coordinator read everything as partition 0. Every commit rewrites the whole
+file with WriteFileAtomic, so a crash leaves either the old or the new offsets
+on disk but never a torn write.
+*/
+type groupOffsets struct {
+	mu      sync.Mutex
+	path    string
+	offsets map[string]map[uint32]uint64
+}
+
+func newGroupOffsets(dir string) (*groupOffsets, error) {
+	g := &groupOffsets{
+		path:    path.Join(dir, offsetsFile),
+		offsets: make(map[string]map[uint32]uint64),
+	}
+	b, err := ioutil.ReadFile(g.path)
+	if os.IsNotExist(err) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = unmarshalOffsets(b, g.offsets); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// unmarshalOffsets reads the groups' offsets into offsets. Files written
+// before groups read partitions hold a single offset per group, which is the
+// group's offset of partition 0.
+func unmarshalOffsets(b []byte, offsets map[string]map[uint32]uint64) error {
+	groups := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &groups); err != nil {
+		return err
+	}
+	for group, raw := range groups {
+		var offset uint64
+		if err := json.Unmarshal(raw, &offset); err == nil {
+			offsets[group] = map[uint32]uint64{0: offset}
+			continue
+		}
+		partitions := make(map[uint32]uint64)
+		if err := json.Unmarshal(raw, &partitions); err != nil {
+			return err
+		}
+		offsets[group] = partitions
+	}
+	return nil
+}
+
+func (g *groupOffsets) Commit(group string, partition uint32, offset uint64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	partitions, ok := g.offsets[group]
+	if !ok {
+		partitions = make(map[uint32]uint64)
+		g.offsets[group] = partitions
+	}
+	prev, ok := partitions[partition]
+	partitions[partition] = offset
+	if err := g.persist(); err != nil {
+		if ok {
+			partitions[partition] = prev
+		} else {
+			delete(partitions, partition)
+		}
+		return err
+	}
+	return nil
+}
+
+func (g *groupOffsets) Fetch(group string, partition uint32) (uint64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	offset, ok := g.offsets[group][partition]
+	if !ok {
+		return 0, api.ErrGroupOffsetNotFound{Group: group, Partition: partition}
+	}
+	return offset, nil
+}
+
+func (g *groupOffsets) persist() error {
+	b, err := json.Marshal(g.offsets)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(g.path, b)
+}
+
+func (g *groupOffsets) marshal() ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return json.Marshal(g.offsets)
+}
+
+// restore replaces the offsets with the marshaled ones and persists them.
+func (g *groupOffsets) restore(b []byte) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	offsets := make(map[string]map[uint32]uint64)
+	if err := unmarshalOffsets(b, offsets); err != nil {
+		return err
+	}
+	g.offsets = offsets
+	return g.persist()
+}
+
+// CommitOffset durably records offset as the next offset the consumer group
+// will consume from the partition.
+func (l *Log) CommitOffset(group string, partition uint32, offset uint64) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.groups.Commit(group, partition, offset)
+}
+
+// FetchOffset returns the consumer group's committed offset for the partition.
+func (l *Log) FetchOffset(group string, partition uint32) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.groups.Fetch(group, partition)
+}
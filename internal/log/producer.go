@@ -0,0 +1,46 @@
+package log
+
+import (
+	api "github.com/Franklynoble/proglog/api/v1"
+)
+
+/*
+producerState tracks the last sequence number a producer appended and the
+offset the log stored that record under. Records carry their producer ID and
+sequence, so the log rebuilds this state from the segments when it starts
+instead of keeping a separate file in sync with them.
+*/
+type producerState struct {
+	sequence uint64
+	offset   uint64
+}
+
+// dedup reports the offset a record was already stored under when its
+// producer has appended the same sequence before. Callers hold the write lock.
+func (l *Log) dedup(record *api.Record) (uint64, bool, error) {
+	if record.ProducerId == "" {
+		return 0, false, nil
+	}
+	state, ok := l.producers[record.ProducerId]
+	if !ok || record.Sequence > state.sequence {
+		return 0, false, nil
+	}
+	if record.Sequence == state.sequence {
+		return state.offset, true, nil
+	}
+	return 0, false, api.ErrStaleSequence{
+		ProducerID: record.ProducerId,
+		Sequence:   record.Sequence,
+		Last:       state.sequence,
+	}
+}
+
+func (l *Log) trackProducer(record *api.Record) {
+	if record.ProducerId == "" {
+		return
+	}
+	l.producers[record.ProducerId] = producerState{
+		sequence: record.Sequence,
+		offset:   record.Offset,
+	}
+}
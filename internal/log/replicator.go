@@ -0,0 +1,329 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+)
+
+/*
+The Replicator copies the logs of peer servers into the local log. For every
+peer it opens a ConsumeStream with the dial options it's given, usually the
+mTLS credentials built with config.SetupTLSConfig, and replicates each record
+it receives verbatim, under the local log's next offset. When a stream breaks
+the Replicator redials and resumes from the peer's next offset until the peer
+leaves or the Replicator closes.
+
+The Replicator keeps each peer's next offset in a file next to the local log's
+segments rather than in the records, so a new Replicator on the same log picks
+up where the last one stopped. Every CommitInterval, and when it closes, it
+syncs the local log and only then records the progress, so the file never
+claims records a crash could still lose; a crash between the two copies the
+records since the last commit again. Records carry their peers' producer and
+transaction IDs as they are, so the local log of several peers only serves as
+their replica, not to producers and transactions of its own.
+*/
+type Replicator struct {
+	DialOptions []grpc.DialOption
+	Local       *Log
+
+	// Backoff is how long the Replicator waits before redialing a peer.
+	Backoff time.Duration
+	// CommitInterval is how often the Replicator syncs the local log and
+	// records the peers' progress, a second if it's 0.
+	CommitInterval time.Duration
+
+	mu       sync.Mutex
+	peers    map[string]*peer
+	progress *replicaProgress
+	closed   bool
+	close    chan struct{}
+	wg       sync.WaitGroup
+}
+
+// peer tracks a peer's replication progress, the next offset to copy.
+type peer struct {
+	addr  string
+	next  uint64
+	leave chan struct{}
+}
+
+// NewReplicator creates a replicator copying the logs of the given peer
+// addresses into local, naming each peer by its address.
+func NewReplicator(
+	local *Log,
+	peers []string,
+	opts ...grpc.DialOption,
+) (*Replicator, error) {
+	r := &Replicator{
+		DialOptions: opts,
+		Local:       local,
+	}
+	for _, addr := range peers {
+		if err := r.Join(addr, addr); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *Replicator) init() error {
+	if r.progress == nil {
+		progress, err := loadReplicaProgress(r.Local.Dir)
+		if err != nil {
+			return err
+		}
+		r.progress = progress
+	}
+	if r.peers == nil {
+		r.peers = make(map[string]*peer)
+	}
+	if r.Backoff == 0 {
+		r.Backoff = time.Second
+	}
+	if r.CommitInterval == 0 {
+		r.CommitInterval = time.Second
+	}
+	if r.close == nil {
+		r.close = make(chan struct{})
+		r.wg.Add(1)
+		go r.commitLoop()
+	}
+	return nil
+}
+
+// Join starts replicating the named peer at addr.
+func (r *Replicator) Join(name, addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	if err := r.init(); err != nil {
+		return err
+	}
+	if _, ok := r.peers[name]; ok {
+		// already replicating so skip
+		return nil
+	}
+	p := &peer{
+		addr:  addr,
+		next:  r.progress.next(addr),
+		leave: make(chan struct{}),
+	}
+	r.peers[name] = p
+	r.wg.Add(1)
+	go r.replicate(p)
+	return nil
+}
+
+// Leave stops replicating the named peer.
+func (r *Replicator) Leave(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.peers[name]
+	if !ok {
+		return nil
+	}
+	close(p.leave)
+	delete(r.peers, name)
+	return nil
+}
+
+// Progress returns the next offset the replicator will copy from each peer,
+// by peer name.
+func (r *Replicator) Progress() map[string]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	progress := make(map[string]uint64, len(r.peers))
+	for name, p := range r.peers {
+		progress[name] = p.next
+	}
+	return progress
+}
+
+// Close stops replicating every peer and waits for the streams to end.
+func (r *Replicator) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	if r.close != nil {
+		close(r.close)
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	if r.progress == nil {
+		return nil
+	}
+	return r.commit()
+}
+
+// commitLoop commits the peers' progress every CommitInterval until the
+// replicator closes.
+func (r *Replicator) commitLoop() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.CommitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-ticker.C:
+			// a failed commit leaves the last progress recorded and
+			// the next tick tries again
+			_ = r.commit()
+		}
+	}
+}
+
+// commit syncs the local log, making the records copied so far durable, and
+// then records how far the replicator got with each peer.
+func (r *Replicator) commit() error {
+	r.mu.Lock()
+	next := make(map[string]uint64, len(r.peers))
+	for _, p := range r.peers {
+		next[p.addr] = p.next
+	}
+	r.mu.Unlock()
+	if err := r.Local.Sync(); err != nil {
+		return err
+	}
+	return r.progress.commit(next)
+}
+
+func (r *Replicator) replicate(p *peer) {
+	defer r.wg.Done()
+	for {
+		r.stream(p)
+		select {
+		case <-r.close:
+			return
+		case <-p.leave:
+			return
+		case <-time.After(r.Backoff):
+		}
+	}
+}
+
+// stream copies the peer's records until the stream breaks, the peer leaves
+// or the replicator closes.
+func (r *Replicator) stream(p *peer) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.close:
+		case <-p.leave:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	cc, err := grpc.DialContext(ctx, p.addr, r.DialOptions...)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	r.mu.Lock()
+	next := p.next
+	r.mu.Unlock()
+
+	client := api.NewLogClient(cc)
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: next})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		// the local log stores the record under its own next offset
+		next := res.Record.Offset + 1
+		if _, err = r.Local.Replicate(res.Record); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		p.next = next
+		r.mu.Unlock()
+	}
+}
+
+// replicasFile is where the Replicator keeps the next offset to copy from each
+// peer, next to the local log's segments.
+const replicasFile = "replicas.offsets"
+
+// replicaProgress stores the next offset to copy from each peer, by address,
+// rewriting the whole file with WriteFileAtomic on every commit.
+type replicaProgress struct {
+	mu    sync.Mutex
+	path  string
+	peers map[string]uint64
+}
+
+func loadReplicaProgress(dir string) (*replicaProgress, error) {
+	p := &replicaProgress{
+		path:  path.Join(dir, replicasFile),
+		peers: make(map[string]uint64),
+	}
+	b, err := ioutil.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &p.peers); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *replicaProgress) next(addr string) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.peers[addr]
+}
+
+// commit records the next offsets of the given peers, keeping the others'
+// as they were, and writes the file if they changed.
+func (p *replicaProgress) commit(next map[string]uint64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	peers := make(map[string]uint64, len(p.peers)+len(next))
+	for addr, off := range p.peers {
+		peers[addr] = off
+	}
+	changed := false
+	for addr, off := range next {
+		if prev, ok := peers[addr]; !ok || prev != off {
+			peers[addr] = off
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	b, err := json.Marshal(peers)
+	if err != nil {
+		return err
+	}
+	if err = WriteFileAtomic(p.path, b); err != nil {
+		return err
+	}
+	p.peers = peers
+	return nil
+}
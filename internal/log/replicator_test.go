@@ -0,0 +1,151 @@
+package log_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+	"github.com/Franklynoble/proglog/internal/auth"
+	"github.com/Franklynoble/proglog/internal/config"
+	"github.com/Franklynoble/proglog/internal/log"
+	"github.com/Franklynoble/proglog/internal/server"
+)
+
+/*
+TestReplicator runs two servers on loopback and replicates both of their logs
+into a third log, then checks the records were copied verbatim and synced and a
+new replicator on the same log picks up where the first one stopped instead
+of copying the records again.
+*/
+func TestReplicator(t *testing.T) {
+	var peers []string
+	var clients []api.LogClient
+	for i := 0; i < 2; i++ {
+		addr, client, teardown := setupPeer(t)
+		defer teardown()
+		peers = append(peers, addr)
+		clients = append(clients, client)
+	}
+
+	dir, err := ioutil.TempDir("", "replicator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// the local log only syncs when the replicator commits its progress
+	c := log.Config{}
+	c.Durability.SyncInterval = time.Hour
+	local, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	sequences := make(map[api.LogClient]uint64)
+	produce := func(client api.LogClient) {
+		sequences[client]++
+		_, err := client.Produce(context.Background(), &api.ProduceRequest{
+			Record:     &api.Record{Value: []byte("hello world")},
+			ProducerId: "producer",
+			Sequence:   sequences[client],
+		})
+		require.NoError(t, err)
+	}
+	for _, client := range clients {
+		produce(client)
+		produce(client)
+	}
+
+	opts := dialOptions(t)
+	replicator, err := log.NewReplicator(local, peers, opts...)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		off, err := local.HighestOffset()
+		return err == nil && off == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, addr := range peers {
+		require.Equal(t, uint64(2), replicator.Progress()[addr])
+	}
+	// the records keep their producers' sequences rather than the peers'
+	// offsets
+	for off := uint64(0); off < 4; off++ {
+		record, err := local.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, "producer", record.ProducerId)
+		require.NotZero(t, record.Sequence)
+	}
+	require.NoError(t, replicator.Close())
+	// the progress recorded on close covers only synced records
+	require.Equal(t, uint64(4), local.Watermark())
+
+	produce(clients[0])
+	replicator, err = log.NewReplicator(local, peers, opts...)
+	require.NoError(t, err)
+	defer replicator.Close()
+
+	require.Eventually(t, func() bool {
+		return replicator.Progress()[peers[0]] == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	off, err := local.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+}
+
+func dialOptions(t *testing.T) []grpc.DialOption {
+	t.Helper()
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.RootClientCertFile,
+		KeyFile:  config.RootClientKeyFile,
+		CAFile:   config.CAFile,
+	})
+	require.NoError(t, err)
+	return []grpc.DialOption{
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+	}
+}
+
+func setupPeer(t *testing.T) (
+	addr string,
+	client api.LogClient,
+	teardown func(),
+) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.ServerCertFile,
+		KeyFile:  config.ServerKeyFile,
+		CAFile:   config.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "replicator-peer-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	srv, err := server.NEWGRPCServer(&server.Config{
+		CommitLog:  clog,
+		Authorizer: auth.New(config.ACLModelFile, config.ACLPolicyFile),
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go func() {
+		srv.Serve(l)
+	}()
+
+	conn, err := grpc.Dial(l.Addr().String(), dialOptions(t)...)
+	require.NoError(t, err)
+
+	return l.Addr().String(), api.NewLogClient(conn), func() {
+		conn.Close()
+		srv.Stop()
+		clog.Remove()
+	}
+}
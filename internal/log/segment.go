@@ -2,8 +2,10 @@ package log
 
 import (
 	"fmt"
+	"hash"
 	"os"
 	"path"
+	"sync"
 
 	"google.golang.org/protobuf/proto"
 
@@ -29,6 +31,12 @@ type segment struct {
 	index                  *index
 	baseOffset, nextOffset uint64
 	config                 Config
+
+	// hash is the segment's rolling checksum, covering the store's first
+	// hashed bytes
+	hashMu sync.Mutex
+	hash   hash.Hash
+	hashed uint64
 }
 
 // END: intro
@@ -122,6 +130,35 @@ func (s *segment) IsMaxed() bool {
 
 // END: ismaxed
 
+// Truncate drops the segment's records from offset off on.
+func (s *segment) Truncate(off uint64) error {
+	if off >= s.nextOffset {
+		return nil
+	}
+	pos, err := s.position(off)
+	if err != nil {
+		return err
+	}
+	if err = s.store.Truncate(pos); err != nil {
+		return err
+	}
+	s.index.Truncate(off - s.baseOffset)
+	s.nextOffset = off
+	// the rolling checksum covered the dropped records
+	s.hashMu.Lock()
+	s.hash = nil
+	s.hashMu.Unlock()
+	return nil
+}
+
+// Sync commits the segment's records and index to stable storage.
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
 // START: close
 func (s *segment) Close() error {
 	if err := s.index.Close(); err != nil {
@@ -0,0 +1,94 @@
+package log
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+var _ raft.StableStore = (*stableStore)(nil)
+
+// errKeyNotFound is the error Raft expects for keys it never set.
+var errKeyNotFound = errors.New("not found")
+
+/*
+stableStore keeps the few keys Raft needs to survive a restart, like the
+current term and the last vote, in a file. Like the groups' offsets, every Set
+rewrites the whole file with WriteFileAtomic.
+*/
+type stableStore struct {
+	mu     sync.Mutex
+	path   string
+	values map[string][]byte
+}
+
+func newStableStore(path string) (*stableStore, error) {
+	s := &stableStore{
+		path:   path,
+		values: make(map[string][]byte),
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &s.values); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *stableStore) Set(key []byte, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.values[string(key)]
+	s.values[string(key)] = append([]byte(nil), val...)
+	if err := s.persist(); err != nil {
+		if ok {
+			s.values[string(key)] = prev
+		} else {
+			delete(s.values, string(key))
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *stableStore) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.values[string(key)]
+	if !ok {
+		return nil, errKeyNotFound
+	}
+	return append([]byte(nil), val...), nil
+}
+
+func (s *stableStore) SetUint64(key []byte, val uint64) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, val)
+	return s.Set(key, b)
+}
+
+func (s *stableStore) GetUint64(key []byte) (uint64, error) {
+	b, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (s *stableStore) persist() error {
+	b, err := json.Marshal(s.values)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(s.path, b)
+}
@@ -111,7 +111,43 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 	return b, nil
 }
 
-//Close() persists any buffered data before closing the file
+// ReadAt(p []byte, off int64) reads len(p) bytes into p beginning at the off
+// offset in the store's file, flushing the writer buffer first.
+func (s *store) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return 0, err
+	}
+	return s.File.ReadAt(p, off)
+}
+
+// Truncate drops the store's bytes from position pos on.
+func (s *store) Truncate(pos uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(pos)); err != nil {
+		return err
+	}
+	s.size = pos
+	return nil
+}
+
+// Sync flushes the buffered records and commits the file to stable storage.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+// Close() persists any buffered data before closing the file
 func (s *store) Close() error {
 
 	s.mu.Lock()
@@ -125,5 +161,3 @@ func (s *store) Close() error {
 	}
 	return s.File.Close()
 }
-
-
@@ -73,6 +73,7 @@ func testReadAt(t *testing.T, s *store) {
 
 		size := enc.Uint64(b)
 		b = make([]byte, size)
+		n, err = s.ReadAt(b, off)
 		require.NoError(t, err)
 		require.Equal(t, int(size), n)
 		off += int64(n)
@@ -104,7 +105,7 @@ func TestStoreClose(t *testing.T) {
 	require.NoError(t, err)
 }
 
-//Assuming these tests pass, you know that your log can append and read
+// Assuming these tests pass, you know that your log can append and read
 // persisted records.
 func openFile(name string) (file *os.File, size int64, err error) {
 
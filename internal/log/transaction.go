@@ -0,0 +1,116 @@
+package log
+
+import (
+	"time"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+)
+
+/*
+A transaction groups records that consumers should see entirely or not at all.
+BeginTransaction appends a BEGIN control record carrying a new transaction ID,
+the transaction's records carry that ID, and a COMMIT or ABORT control record
+ends it. Like the producer sequences, the log rebuilds the transaction states
+from these records when it starts.
+*/
+type TransactionState int
+
+const (
+	TransactionUnknown TransactionState = iota
+	TransactionOpen
+	TransactionCommitted
+	TransactionAborted
+)
+
+// BeginTransaction appends a BEGIN control record and returns the new
+// transaction's ID. IDs start at 1; 0 marks records outside a transaction.
+func (l *Log) BeginTransaction() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id := l.nextTransaction
+	if _, err := l.append(&api.Record{
+		TransactionId: id,
+		Control:       api.ControlType_BEGIN,
+	}); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// CommitTransaction appends a COMMIT control record for the open transaction
+// and returns the record's offset.
+func (l *Log) CommitTransaction(id uint64) (uint64, error) {
+	return l.endTransaction(id, api.ControlType_COMMIT)
+}
+
+// AbortTransaction appends an ABORT control record for the open transaction
+// and returns the record's offset.
+func (l *Log) AbortTransaction(id uint64) (uint64, error) {
+	return l.endTransaction(id, api.ControlType_ABORT)
+}
+
+func (l *Log) endTransaction(id uint64, control api.ControlType) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.transactions[id] != TransactionOpen {
+		return 0, api.ErrTransactionNotOpen{TransactionID: id}
+	}
+	return l.append(&api.Record{
+		TransactionId: id,
+		Control:       control,
+	})
+}
+
+// TransactionState returns the state of the transaction with the given ID.
+func (l *Log) TransactionState(id uint64) TransactionState {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.transactions[id]
+}
+
+/*
+ExpiredTransactions returns the IDs of the open transactions that began more
+than timeout ago, going by their BEGIN records' timestamps, so a server can
+abort the transactions of producers that died before ending them.
+*/
+func (l *Log) ExpiredTransactions(timeout time.Duration) []uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	began := time.Now().Add(-timeout).UnixNano()
+	var ids []uint64
+	for id, timestamp := range l.transactionBegins {
+		if timestamp < began {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// checkTransaction makes sure a transactional record belongs to an open
+// transaction. Callers hold the write lock.
+func (l *Log) checkTransaction(record *api.Record) error {
+	if record.TransactionId == 0 {
+		return nil
+	}
+	if l.transactions[record.TransactionId] != TransactionOpen {
+		return api.ErrTransactionNotOpen{TransactionID: record.TransactionId}
+	}
+	return nil
+}
+
+func (l *Log) trackTransaction(record *api.Record) {
+	switch record.Control {
+	case api.ControlType_BEGIN:
+		l.transactions[record.TransactionId] = TransactionOpen
+		l.transactionBegins[record.TransactionId] = record.Timestamp
+		if record.TransactionId >= l.nextTransaction {
+			l.nextTransaction = record.TransactionId + 1
+		}
+	case api.ControlType_COMMIT:
+		l.transactions[record.TransactionId] = TransactionCommitted
+		delete(l.transactionBegins, record.TransactionId)
+	case api.ControlType_ABORT:
+		l.transactions[record.TransactionId] = TransactionAborted
+		delete(l.transactionBegins, record.TransactionId)
+	}
+}
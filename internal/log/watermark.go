@@ -0,0 +1,132 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// checkpointFile is where the log keeps its durable watermark, next to its
+// segments.
+const checkpointFile = "durable.checkpoint"
+
+/*
+Watermark returns the log's durable watermark: every record below it has been
+synced to stable storage and survives a crash, while records at or above it
+may still sit in a store's buffer. Unlike HighestOffset, the watermark only
+moves once the records are synced. The checkpoint file recording it is only
+written by Sync, the syncer and Close, not on every append: after a crash the
+log syncs whatever its segments recovered past the checkpoint anyway.
+*/
+func (l *Log) Watermark() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.watermark
+}
+
+// Sync commits the records appended since the last sync to stable storage and
+// advances the watermark past them.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sync()
+}
+
+// sync does what Sync does for callers already holding the write lock.
+func (l *Log) sync() error {
+	if err := l.flush(); err != nil {
+		return err
+	}
+	if l.watermark == l.checkpointed {
+		return nil
+	}
+	return l.writeCheckpoint(l.watermark)
+}
+
+// flush syncs the segments' records past the watermark and advances the
+// watermark past them, leaving the checkpoint file to sync. Callers hold the
+// write lock.
+func (l *Log) flush() error {
+	next := l.activeSegment.nextOffset
+	if next == l.watermark {
+		return nil
+	}
+	for _, s := range l.segments {
+		if s.nextOffset <= l.watermark {
+			continue
+		}
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+	l.watermark = next
+	return nil
+}
+
+/*
+loadWatermark restores the watermark from the checkpoint file, clamped to the
+log's offsets, and syncs whatever the segments hold beyond it: those records
+are what the log recovered, so once synced they're as durable as the rest.
+*/
+func (l *Log) loadWatermark() error {
+	l.watermark = l.segments[0].baseOffset
+	l.checkpointed = 0
+	b, err := ioutil.ReadFile(path.Join(l.Dir, checkpointFile))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case len(b) == 8:
+		checkpoint := enc.Uint64(b)
+		l.checkpointed = checkpoint
+		if checkpoint > l.watermark {
+			l.watermark = checkpoint
+		}
+		if next := l.activeSegment.nextOffset; l.watermark > next {
+			l.watermark = next
+		}
+	}
+	return l.sync()
+}
+
+// writeCheckpoint durably replaces the checkpoint file with the watermark.
+func (l *Log) writeCheckpoint(watermark uint64) error {
+	b := make([]byte, 8)
+	enc.PutUint64(b, watermark)
+	if err := WriteFileAtomic(path.Join(l.Dir, checkpointFile), b); err != nil {
+		return err
+	}
+	l.checkpointed = watermark
+	return nil
+}
+
+// startSyncer syncs the log every interval until stopSyncer is called.
+func (l *Log) startSyncer(interval time.Duration) {
+	l.syncerDone = make(chan struct{})
+	l.syncerStopped = make(chan struct{})
+	go func() {
+		defer close(l.syncerStopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.syncerDone:
+				return
+			case <-ticker.C:
+				// a failed sync leaves the watermark where it was
+				// and the next tick tries again
+				_ = l.Sync()
+			}
+		}
+	}()
+}
+
+func (l *Log) stopSyncer() {
+	if l.syncerDone == nil {
+		return
+	}
+	close(l.syncerDone)
+	<-l.syncerStopped
+	l.syncerDone = nil
+}
@@ -0,0 +1,327 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+	plog "github.com/Franklynoble/proglog/internal/log"
+)
+
+// Config configures a Mirror.
+type Config struct {
+	// Source is the server the mirror consumes from and Destination the
+	// one it produces to.
+	Source      api.LogClient
+	Destination api.LogClient
+	// CheckpointFile keeps the next source offset to mirror so a restarted
+	// mirror resumes where it stopped. Without a checkpoint the mirror
+	// starts at StartOffset.
+	CheckpointFile string
+	StartOffset    uint64
+	// Topics limits the mirror to the records of these topics; an empty
+	// list mirrors every record.
+	Topics []string
+	// Renames maps source topics to the topics their records get in the
+	// destination. Topics it doesn't list keep their names.
+	Renames map[string]string
+	// ProducerID is the producer the mirror appends to the destination as,
+	// using the records' source offsets as sequences so the destination
+	// drops the records a restarted mirror sends again. Mirrors sharing a
+	// destination need different producer IDs.
+	ProducerID string
+	// CheckpointInterval is how often the checkpoint is written and
+	// RetryInterval how long the mirror waits before reconnecting after an
+	// error.
+	CheckpointInterval time.Duration
+	RetryInterval      time.Duration
+	// Window bounds the records produced to the destination that it hasn't
+	// acknowledged yet.
+	Window int
+}
+
+/*
+Mirror continuously copies a source server's records to a destination server.
+It consumes the source's committed records with ConsumeStream and produces the
+ones its topics select with ProduceStream, keeping their values, headers and
+timestamps. A record's source offset only counts as mirrored once the
+destination acknowledged it, and the checkpoint never moves past a record that
+isn't, so a mirror that crashes sends some records again but never skips one.
+*/
+type Mirror struct {
+	Config
+
+	topics map[string]bool
+
+	mu sync.Mutex
+	// next is the source offset of the first record not mirrored yet
+	next         uint64
+	checkpointed uint64
+}
+
+// New creates a mirror resuming from the checkpoint file, if there is one.
+func New(config Config) (*Mirror, error) {
+	if config.Source == nil || config.Destination == nil {
+		return nil, errors.New("a mirror needs a source and a destination")
+	}
+	if config.ProducerID == "" {
+		config.ProducerID = "proglog-mirror"
+	}
+	if config.CheckpointInterval == 0 {
+		config.CheckpointInterval = time.Second
+	}
+	if config.RetryInterval == 0 {
+		config.RetryInterval = time.Second
+	}
+	if config.Window == 0 {
+		config.Window = 64
+	}
+	m := &Mirror{
+		Config: config,
+		next:   config.StartOffset,
+	}
+	if len(config.Topics) > 0 {
+		m.topics = make(map[string]bool)
+		for _, topic := range config.Topics {
+			m.topics[topic] = true
+		}
+	}
+	if config.CheckpointFile != "" {
+		b, err := ioutil.ReadFile(config.CheckpointFile)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, err
+		default:
+			if m.next, err = strconv.ParseUint(string(b), 10, 64); err != nil {
+				return nil, err
+			}
+		}
+	}
+	m.checkpointed = m.next
+	return m, nil
+}
+
+// Next returns the source offset of the first record not mirrored yet.
+func (m *Mirror) Next() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.next
+}
+
+/*
+Run mirrors records until ctx is done, reconnecting to the servers after
+errors, and writes the checkpoint a last time before returning. It only
+returns an error when the checkpoint can't be written.
+*/
+func (m *Mirror) Run(ctx context.Context) error {
+	done := make(chan struct{})
+	stopped := make(chan error, 1)
+	go func() {
+		ticker := time.NewTicker(m.CheckpointInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				stopped <- nil
+				return
+			case <-ticker.C:
+				if err := m.checkpoint(); err != nil {
+					stopped <- err
+					return
+				}
+			}
+		}
+	}()
+
+	for ctx.Err() == nil {
+		err := m.mirror(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		if errors.Is(err, errStale) {
+			// the destination already holds the records, resume
+			// after them right away
+			continue
+		}
+		log.Printf("[ERROR] mirror: %v", err)
+		select {
+		case <-ctx.Done():
+		case err = <-stopped:
+			return err
+		case <-time.After(m.RetryInterval):
+		}
+	}
+	close(done)
+	if err := <-stopped; err != nil {
+		return err
+	}
+	return m.checkpoint()
+}
+
+// errStale ends a mirroring session that sent records the destination already
+// holds.
+var errStale = errors.New("destination already holds the records")
+
+// pending is a record the mirror consumed, waiting for the destination to
+// acknowledge it unless the mirror filtered it out.
+type pending struct {
+	offset   uint64
+	produced bool
+}
+
+// mirror copies records from the next offset on until either stream fails.
+func (m *Mirror) mirror(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	consume, err := m.Source.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:    m.Next(),
+		Isolation: api.IsolationLevel_READ_COMMITTED,
+	})
+	if err != nil {
+		return err
+	}
+	produce, err := m.Destination.ProduceStream(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the destination acknowledges records in the order they're produced
+	acks := make(chan pending, m.Window)
+	errc := make(chan error, 1)
+	acked := make(chan struct{})
+	defer func() {
+		// the session's acknowledgements are in before the next
+		// session reads the next offset
+		cancel()
+		close(acks)
+		<-acked
+	}()
+	go func() {
+		defer close(acked)
+		for p := range acks {
+			if p.produced {
+				if _, err := produce.Recv(); err != nil {
+					errc <- m.stale(err)
+					cancel()
+					return
+				}
+			}
+			m.mu.Lock()
+			m.next = p.offset + 1
+			m.mu.Unlock()
+		}
+	}()
+	// fail prefers the acknowledgements' error, which ends the streams
+	fail := func(err error) error {
+		select {
+		case ackErr := <-errc:
+			return ackErr
+		default:
+			return err
+		}
+	}
+
+	for {
+		res, err := consume.Recv()
+		if err != nil {
+			return fail(err)
+		}
+		p := pending{offset: res.Record.Offset}
+		if req := m.request(res.Record); req != nil {
+			if err = produce.Send(req); err != nil {
+				return fail(err)
+			}
+			p.produced = true
+		}
+		select {
+		case acks <- p:
+		case err = <-errc:
+			return err
+		}
+	}
+}
+
+// request returns the request producing the record to the destination, or nil
+// if the mirror's topics leave it out.
+func (m *Mirror) request(record *api.Record) *api.ProduceRequest {
+	if m.topics != nil && !m.topics[record.Topic] {
+		return nil
+	}
+	topic := record.Topic
+	if renamed, ok := m.Renames[topic]; ok {
+		topic = renamed
+	}
+	return &api.ProduceRequest{
+		Record: &api.Record{
+			Value:     record.Value,
+			Timestamp: record.Timestamp,
+			Topic:     topic,
+			Headers:   record.Headers,
+		},
+		ProducerId: m.ProducerID,
+		Sequence:   record.Offset,
+	}
+}
+
+/*
+stale turns the destination rejecting a record it already holds into errStale,
+moving the next offset past the records the destination has. The mirror sends
+records again when it restarts from a checkpoint older than its last
+acknowledged record; the destination drops the last one it appended but
+rejects any before it.
+*/
+func (m *Mirror) stale(err error) error {
+	st := status.Convert(err)
+	if st.Code() != codes.AlreadyExists {
+		return err
+	}
+	for _, detail := range st.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.Reason != "STALE_SEQUENCE" {
+			continue
+		}
+		last, perr := strconv.ParseUint(info.Metadata["last"], 10, 64)
+		if perr != nil {
+			return err
+		}
+		m.mu.Lock()
+		if last+1 > m.next {
+			m.next = last + 1
+		}
+		m.mu.Unlock()
+		return errStale
+	}
+	return err
+}
+
+// checkpoint durably writes the next offset to the checkpoint file if it moved
+// since the last checkpoint.
+func (m *Mirror) checkpoint() error {
+	if m.CheckpointFile == "" {
+		return nil
+	}
+	next := m.Next()
+	if next == m.checkpointed {
+		return nil
+	}
+	err := plog.WriteFileAtomic(
+		m.CheckpointFile,
+		[]byte(strconv.FormatUint(next, 10)),
+	)
+	if err != nil {
+		return err
+	}
+	m.checkpointed = next
+	return nil
+}
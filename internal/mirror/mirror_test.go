@@ -0,0 +1,154 @@
+package mirror
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+	"github.com/Franklynoble/proglog/internal/auth"
+	"github.com/Franklynoble/proglog/internal/config"
+	"github.com/Franklynoble/proglog/internal/log"
+	"github.com/Franklynoble/proglog/internal/server"
+)
+
+func TestMirror(t *testing.T) {
+	source := newServer(t)
+	destination := newServer(t)
+	ctx := context.Background()
+
+	produce := func(topic, value string) {
+		_, err := source.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte(value),
+				Topic: topic,
+				Headers: []*api.Header{
+					{Key: "key", Value: []byte(value)},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+	produce("orders", "first")
+	produce("audit", "skipped")
+	produce("payments", "second")
+
+	dir, err := ioutil.TempDir("", "mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{
+		Source:             source,
+		Destination:        destination,
+		CheckpointFile:     path.Join(dir, "checkpoint"),
+		Topics:             []string{"orders", "payments"},
+		Renames:            map[string]string{"orders": "eu.orders"},
+		CheckpointInterval: 10 * time.Millisecond,
+		RetryInterval:      10 * time.Millisecond,
+	}
+	run := func() (stop func()) {
+		m, err := New(c)
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(ctx)
+		errc := make(chan error)
+		go func() { errc <- m.Run(ctx) }()
+		return func() {
+			cancel()
+			require.NoError(t, <-errc)
+		}
+	}
+
+	stop := run()
+	require.Eventually(t, func() bool {
+		_, err := destination.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+		return err == nil
+	}, 3*time.Second, 10*time.Millisecond)
+	stop()
+
+	b, err := ioutil.ReadFile(c.CheckpointFile)
+	require.NoError(t, err)
+	require.Equal(t, "3", string(b))
+	for off, want := range []*api.Record{
+		{Value: []byte("first"), Topic: "eu.orders"},
+		{Value: []byte("second"), Topic: "payments"},
+	} {
+		res, err := destination.Consume(ctx, &api.ConsumeRequest{
+			Offset: uint64(off),
+		})
+		require.NoError(t, err)
+		require.Equal(t, want.Value, res.Record.Value)
+		require.Equal(t, want.Topic, res.Record.Topic)
+		require.Equal(t, want.Value, res.Record.Headers[0].Value)
+	}
+
+	// a mirror restarted from an older checkpoint doesn't duplicate records
+	require.NoError(t, ioutil.WriteFile(c.CheckpointFile, []byte("0"), 0644))
+	produce("orders", "third")
+	stop = run()
+	require.Eventually(t, func() bool {
+		_, err := destination.Consume(ctx, &api.ConsumeRequest{Offset: 2})
+		return err == nil
+	}, 3*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+
+	res, err := destination.Consume(ctx, &api.ConsumeRequest{Offset: 2})
+	require.NoError(t, err)
+	require.Equal(t, []byte("third"), res.Record.Value)
+	_, err = destination.Consume(ctx, &api.ConsumeRequest{Offset: 3})
+	require.Error(t, err)
+	b, err = ioutil.ReadFile(c.CheckpointFile)
+	require.NoError(t, err)
+	require.Equal(t, "4", string(b))
+}
+
+// newServer serves a new log over mTLS and returns a root client of it.
+func newServer(t *testing.T) api.LogClient {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.ServerCertFile,
+		KeyFile:  config.ServerKeyFile,
+		CAFile:   config.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "mirror-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	srv, err := server.NEWGRPCServer(&server.Config{
+		CommitLog:  clog,
+		Authorizer: auth.New(config.ACLModelFile, config.ACLPolicyFile),
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go srv.Serve(l)
+
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.RootClientCertFile,
+		KeyFile:  config.RootClientKeyFile,
+		CAFile:   config.CAFile,
+	})
+	require.NoError(t, err)
+	cc, err := grpc.Dial(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(credentials.NewTLS(clientTLSConfig)),
+	)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		cc.Close()
+		srv.Stop()
+		clog.Remove()
+	})
+	return api.NewLogClient(cc)
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+)
+
+// jsonMarshaler marshals the HTTP API's messages as protobuf JSON, on the
+// gateway's routes and the HTTP server's own alike, so every route speaks the
+// same JSON.
+var jsonMarshaler = &runtime.JSONPb{OrigName: true, EmitDefaults: true}
+
+/*
+newGateway returns the gRPC-JSON gateway generated from the HTTP annotations
+in log.proto, serving the Log service's RPCs as REST under /v1. Requests and
+responses are the RPCs' messages as protobuf JSON, and ConsumeStream streams
+its responses as newline-delimited JSON, each line a {"result": ...} object
+or, when the stream fails, an {"error": ...} one.
+
+The gateway calls the gRPC handlers in process through localClient rather than
+dialing the gRPC server, so the HTTP client's certificate authorizes its
+requests. GET /v1/records/{offset} takes the same wait parameter as
+GET /records/{offset}, which gatewayWait passes on to localClient.
+*/
+func newGateway(srv *httpServer) (http.Handler, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, jsonMarshaler),
+		runtime.WithProtoErrorHandler(writeGatewayError),
+		runtime.WithStreamErrorHandler(gatewayStreamError),
+		runtime.WithMetadata(gatewayWait),
+	)
+	err := api.RegisterLogHandlerClient(
+		context.Background(),
+		mux,
+		localClient{srv: srv},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r.WithContext(requestContext(r)))
+	}), nil
+}
+
+// waitMetadataKey is the metadata key gatewayWait passes the wait parameter
+// on under.
+const waitMetadataKey = "proglog-wait"
+
+// gatewayWait passes the request's wait parameter on to localClient as
+// metadata, since ConsumeRequest has no field for it.
+func gatewayWait(_ context.Context, r *http.Request) metadata.MD {
+	if v := r.URL.Query().Get("wait"); v != "" {
+		return metadata.Pairs(waitMetadataKey, v)
+	}
+	return nil
+}
+
+// writeGatewayError replies with the error's status as JSON, under the HTTP
+// status writeError would reply with.
+func writeGatewayError(
+	_ context.Context,
+	_ *runtime.ServeMux,
+	marshaler runtime.Marshaler,
+	w http.ResponseWriter,
+	_ *http.Request,
+	err error,
+) {
+	st := status.Convert(err)
+	b, merr := marshaler.Marshal(st.Proto())
+	if merr != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Del("Trailer")
+	w.Header().Set("Content-Type", marshaler.ContentType())
+	w.WriteHeader(httpStatus(st.Code()))
+	w.Write(b)
+}
+
+// gatewayStreamError is the error ending a ConsumeStream response.
+func gatewayStreamError(_ context.Context, err error) *runtime.StreamError {
+	st := status.Convert(err)
+	code := httpStatus(st.Code())
+	return &runtime.StreamError{
+		GrpcCode:   int32(st.Code()),
+		HttpCode:   int32(code),
+		Message:    st.Message(),
+		HttpStatus: http.StatusText(code),
+	}
+}
+
+/*
+localClient is an api.LogClient calling the gRPC server's handlers directly,
+with the subject of the gateway's request in the context. The gateway serves
+no client-streaming RPCs, so ProduceStream and Replay are unimplemented.
+*/
+type localClient struct {
+	srv *httpServer
+}
+
+var _ api.LogClient = localClient{}
+
+func (c localClient) Produce(
+	ctx context.Context,
+	in *api.ProduceRequest,
+	_ ...grpc.CallOption,
+) (*api.ProduceResponse, error) {
+	return c.srv.grpc.Produce(ctx, in)
+}
+
+// Consume long-polls the log's tail for up to the wait gatewayWait passed on
+// from the request's query, like GET /records/{offset}?wait=.
+func (c localClient) Consume(
+	ctx context.Context,
+	in *api.ConsumeRequest,
+	_ ...grpc.CallOption,
+) (*api.ConsumeResponse, error) {
+	var wait time.Duration
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if v := md.Get(waitMetadataKey); len(v) > 0 {
+		var err error
+		if wait, err = parseWait(v[0]); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	return c.srv.consume(ctx, in.Offset, wait)
+}
+
+// ConsumeStream runs the handler in a goroutine sending its responses to the
+// returned stream, until the context ends.
+func (c localClient) ConsumeStream(
+	ctx context.Context,
+	in *api.ConsumeRequest,
+	_ ...grpc.CallOption,
+) (api.Log_ConsumeStreamClient, error) {
+	stream := &localConsumeStream{
+		ctx:       ctx,
+		responses: make(chan *api.ConsumeResponse),
+		done:      make(chan struct{}),
+	}
+	go func() {
+		defer close(stream.done)
+		stream.err = c.srv.grpc.ConsumeStream(in, stream)
+	}()
+	return stream, nil
+}
+
+func (c localClient) ProduceStream(
+	context.Context,
+	...grpc.CallOption,
+) (api.Log_ProduceStreamClient, error) {
+	return nil, status.Error(
+		codes.Unimplemented,
+		"the gateway doesn't serve ProduceStream",
+	)
+}
+
+func (c localClient) BeginTransaction(
+	ctx context.Context,
+	in *api.BeginTransactionRequest,
+	_ ...grpc.CallOption,
+) (*api.BeginTransactionResponse, error) {
+	return c.srv.grpc.BeginTransaction(ctx, in)
+}
+
+func (c localClient) CommitTransaction(
+	ctx context.Context,
+	in *api.EndTransactionRequest,
+	_ ...grpc.CallOption,
+) (*api.EndTransactionResponse, error) {
+	return c.srv.grpc.CommitTransaction(ctx, in)
+}
+
+func (c localClient) AbortTransaction(
+	ctx context.Context,
+	in *api.EndTransactionRequest,
+	_ ...grpc.CallOption,
+) (*api.EndTransactionResponse, error) {
+	return c.srv.grpc.AbortTransaction(ctx, in)
+}
+
+func (c localClient) CommitOffset(
+	ctx context.Context,
+	in *api.CommitOffsetRequest,
+	_ ...grpc.CallOption,
+) (*api.CommitOffsetResponse, error) {
+	return c.srv.grpc.CommitOffset(ctx, in)
+}
+
+func (c localClient) FetchOffset(
+	ctx context.Context,
+	in *api.FetchOffsetRequest,
+	_ ...grpc.CallOption,
+) (*api.FetchOffsetResponse, error) {
+	return c.srv.grpc.FetchOffset(ctx, in)
+}
+
+func (c localClient) JoinGroup(
+	ctx context.Context,
+	in *api.JoinGroupRequest,
+	_ ...grpc.CallOption,
+) (*api.GroupMembership, error) {
+	return c.srv.grpc.JoinGroup(ctx, in)
+}
+
+func (c localClient) Heartbeat(
+	ctx context.Context,
+	in *api.HeartbeatRequest,
+	_ ...grpc.CallOption,
+) (*api.GroupMembership, error) {
+	return c.srv.grpc.Heartbeat(ctx, in)
+}
+
+func (c localClient) LeaveGroup(
+	ctx context.Context,
+	in *api.LeaveGroupRequest,
+	_ ...grpc.CallOption,
+) (*api.LeaveGroupResponse, error) {
+	return c.srv.grpc.LeaveGroup(ctx, in)
+}
+
+func (c localClient) GetServers(
+	ctx context.Context,
+	in *api.GetServersRequest,
+	_ ...grpc.CallOption,
+) (*api.GetServersResponse, error) {
+	return c.srv.grpc.GetServers(ctx, in)
+}
+
+func (c localClient) Replay(
+	context.Context,
+	...grpc.CallOption,
+) (api.Log_ReplayClient, error) {
+	return nil, status.Error(
+		codes.Unimplemented,
+		"the gateway doesn't serve Replay",
+	)
+}
+
+func (c localClient) GetChecksums(
+	ctx context.Context,
+	in *api.GetChecksumsRequest,
+	_ ...grpc.CallOption,
+) (*api.GetChecksumsResponse, error) {
+	return c.srv.grpc.GetChecksums(ctx, in)
+}
+
+/*
+localConsumeStream connects a ConsumeStream handler to the gateway: it's the
+handler's api.Log_ConsumeStreamServer and the gateway's
+api.Log_ConsumeStreamClient. Send hands the gateway each response, and Recv
+returns the handler's error, or io.EOF, once the handler returned.
+*/
+type localConsumeStream struct {
+	ctx       context.Context
+	responses chan *api.ConsumeResponse
+	done      chan struct{}
+	err       error
+}
+
+func (s *localConsumeStream) Send(res *api.ConsumeResponse) error {
+	select {
+	case s.responses <- res:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *localConsumeStream) Recv() (*api.ConsumeResponse, error) {
+	select {
+	case res := <-s.responses:
+		return res, nil
+	case <-s.done:
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+}
+
+func (s *localConsumeStream) Context() context.Context {
+	return s.ctx
+}
+
+// The rest of the stream interfaces carry no metadata and no other messages.
+
+func (s *localConsumeStream) SetHeader(metadata.MD) error  { return nil }
+func (s *localConsumeStream) SendHeader(metadata.MD) error { return nil }
+func (s *localConsumeStream) SetTrailer(metadata.MD)       {}
+
+func (s *localConsumeStream) Header() (metadata.MD, error) {
+	return metadata.MD{}, nil
+}
+
+func (s *localConsumeStream) Trailer() metadata.MD { return metadata.MD{} }
+func (s *localConsumeStream) CloseSend() error     { return nil }
+
+func (s *localConsumeStream) SendMsg(interface{}) error {
+	return status.Error(codes.Unimplemented, "unexpected message")
+}
+
+func (s *localConsumeStream) RecvMsg(interface{}) error {
+	return status.Error(codes.Unimplemented, "unexpected message")
+}
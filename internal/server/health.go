@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+)
+
+// healthCheckInterval is how often a health watch checks the log.
+const healthCheckInterval = time.Second
+
+/*
+healthServer implements the standard gRPC health service, grpc.health.v1. Both
+the server as a whole, the empty service name, and the Log service are SERVING
+while the log is healthy and NOT_SERVING while it isn't: before it's set up,
+when its disk is full or, for a distributed log, while the cluster has no
+leader. A server shutting down doesn't serve either. The health service
+answers without authorization so orchestrators can probe it with any
+certificate the CA signed.
+*/
+type healthServer struct {
+	log          CommitLog
+	shuttingDown <-chan struct{}
+}
+
+var _ grpc_health_v1.HealthServer = (*healthServer)(nil)
+
+func (s *healthServer) Check(
+	ctx context.Context,
+	req *grpc_health_v1.HealthCheckRequest,
+) (*grpc_health_v1.HealthCheckResponse, error) {
+	if err := checkService(req.Service); err != nil {
+		return nil, err
+	}
+	return &grpc_health_v1.HealthCheckResponse{Status: s.status()}, nil
+}
+
+// Watch sends the service's status and then every change of it until the
+// client ends the call.
+func (s *healthServer) Watch(
+	req *grpc_health_v1.HealthCheckRequest,
+	stream grpc_health_v1.Health_WatchServer,
+) error {
+	if err := checkService(req.Service); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	shuttingDown := s.shuttingDown
+	last := grpc_health_v1.HealthCheckResponse_UNKNOWN
+	for {
+		if current := s.status(); current != last {
+			if err := stream.Send(&grpc_health_v1.HealthCheckResponse{
+				Status: current,
+			}); err != nil {
+				return err
+			}
+			last = current
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-shuttingDown:
+			// report the shutdown right away, once
+			shuttingDown = nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *healthServer) status() grpc_health_v1.HealthCheckResponse_ServingStatus {
+	select {
+	case <-s.shuttingDown:
+		return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	default:
+	}
+	if s.log.Health() != nil {
+		return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	return grpc_health_v1.HealthCheckResponse_SERVING
+}
+
+// checkService fails with NotFound for the services the server doesn't have.
+func checkService(service string) error {
+	if service != "" && service != api.Log_ServiceDesc.ServiceName {
+		return status.Errorf(codes.NotFound, "unknown service %q", service)
+	}
+	return nil
+}
+
+// handleHealthz serves GET /healthz, the liveness probe: the server answers,
+// so it's alive, even when the log can't serve.
+func (s *httpServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz serves GET /readyz, the readiness probe: a 503 with the reason
+// while the gRPC health service reports NOT_SERVING.
+func (s *httpServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.grpc.shuttingDown() {
+		writeError(w, api.ErrShuttingDown{})
+		return
+	}
+	if err := s.grpc.CommitLog.Health(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
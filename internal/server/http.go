@@ -1,123 +1,376 @@
 package server
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/Franklynoble/proglog/api/v1"
 )
 
 /*
-NewHTTPServer(addr string) takes in an address for the server to run on and returns
-an *http.Server
+NewHTTPServer(addr string, config *Config) takes in an address for the server
+to run on and the config the gRPC server takes, and returns an *http.Server
+serving the same log as JSON: the gateway generated from log.proto serves the
+Log service under /v1, next to the record routes, the event stream, the
+WebSocket and the health probes. Set the returned server's TLSConfig to
+require client certificates: like the gRPC server, the HTTP server authorizes
+clients by their certificate's common name.
 */
 
-func NewHTTPServer(addr string) *http.Server {
-	httpsrv := newHTTPServer()
+func NewHTTPServer(addr string, config *Config) (*http.Server, error) {
+	httpsrv, err := newHTTPServer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	gateway, err := newGateway(httpsrv)
+	if err != nil {
+		return nil, err
+	}
 
 	r := mux.NewRouter()
 
-	r.HandleFunc("/", httpsrv.handleProduce).Methods("POST")
-	r.HandleFunc("/", httpsrv.handleConsume).Methods("GET")
+	r.PathPrefix("/v1/").Handler(gateway)
+	r.HandleFunc("/records", httpsrv.handleProduceRecords).Methods("POST")
+	r.HandleFunc("/records", httpsrv.handleListRecords).Methods("GET")
+	r.HandleFunc("/records/{offset:[0-9]+}", httpsrv.handleGetRecord).
+		Methods("GET")
+	r.HandleFunc("/records/stream", httpsrv.handleStreamRecords).
+		Methods("GET")
+	r.HandleFunc("/offsets", httpsrv.handleOffsets).Methods("GET")
+	r.HandleFunc("/ws", httpsrv.handleWebSocket).Methods("GET")
+	r.HandleFunc("/healthz", httpsrv.handleHealthz).Methods("GET")
+	r.HandleFunc("/readyz", httpsrv.handleReadyz).Methods("GET")
 
 	return &http.Server{
 		Addr:    addr,
 		Handler: r,
-	}
+	}, nil
 }
 
+/*
+httpServer translates HTTP requests into calls to the gRPC server's handlers,
+so both APIs authorize, read and write the log the same way.
+*/
 type httpServer struct {
-	Log *Log
+	grpc *grpcServer
 }
 
-func newHTTPServer() *httpServer {
-	return &httpServer{
-		Log: NewLog(),
+func newHTTPServer(config *Config) (*httpServer, error) {
+	srv, err := newgrpcServer(config)
+	if err != nil {
+		return nil, err
 	}
+	return &httpServer{grpc: srv}, nil
 }
 
-type ProduceRequest struct {
-	Record Record `json:"record"`
-}
+const (
+	// defaultLimit and maxLimit bound the records a page holds.
+	defaultLimit = 100
+	maxLimit     = 1000
+)
 
-type ProduceResponse struct {
-	Offset uint64 `json:"offset"`
+// handleGetRecord serves GET /records/{offset}?wait=.
+func (s *httpServer) handleGetRecord(w http.ResponseWriter, r *http.Request) {
+	offset, err := strconv.ParseUint(mux.Vars(r)["offset"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wait, err := parseWait(r.URL.Query().Get("wait"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := s.consume(requestContext(r), offset, wait)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, res)
 }
 
-type ConsumeRequest struct {
-	Offset uint64 `json:"offset"`
-}
-type ConsumeResponse struct {
-	Record Record `json:"record"`
+/*
+handleListRecords serves GET /records?from=&limit=&wait=, a page of up to
+limit records from the from offset on. A page ends early at the end of the
+log, so a client following the log asks for the next page again until it fills
+up; with wait, a page that would be empty waits for its first record.
+*/
+func (s *httpServer) handleListRecords(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var from uint64
+	limit := defaultLimit
+	var err error
+	if v := query.Get("from"); v != "" {
+		if from, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "from must be an offset", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxLimit {
+			http.Error(
+				w,
+				fmt.Sprintf("limit must be between 1 and %d", maxLimit),
+				http.StatusBadRequest,
+			)
+			return
+		}
+	}
+	wait, err := parseWait(r.URL.Query().Get("wait"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := requestContext(r)
+	res := &api.ListRecordsResponse{Next: from}
+	for len(res.Records) < limit {
+		consume, err := s.tail(ctx, res.Next, wait)
+		wait = 0
+		if err == errNotAppended {
+			break
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		res.Records = append(res.Records, consume.Record)
+		res.Next++
+	}
+	writeJSON(w, res)
 }
 
 /*
-We now have a server referencing a log for the server to defer to in its handlers.
-A produce request contains the record that the caller of our API wants
-appended to the log, and a produce response tells the caller what offset the
-log stored the records under. A consume request specifies which records the
+handleProduceRecords serves POST /records, appending a single record or a
+batch. A batch's records are appended in order; when one fails, the ones
+before it stay appended.
 */
+func (s *httpServer) handleProduceRecords(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	var req api.ProduceRecordsRequest
+	err := jsonMarshaler.NewDecoder(r.Body).Decode(&req)
+	if err != nil || (req.Record == nil) == (len(req.Records) == 0) {
+		http.Error(
+			w,
+			"a produce request needs either a record or records",
+			http.StatusBadRequest,
+		)
+		return
+	}
+	ctx := requestContext(r)
+	if req.Record != nil {
+		res, err := s.grpc.Produce(ctx, &api.ProduceRequest{Record: req.Record})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, &api.ProduceRecordsResponse{Offset: &res.Offset})
+		return
+	}
+	for _, record := range req.Records {
+		if record == nil {
+			// fail the whole batch before appending any of it
+			http.Error(w, "a batch can't hold null records", http.StatusBadRequest)
+			return
+		}
+	}
+	res := &api.ProduceRecordsResponse{}
+	for _, record := range req.Records {
+		produce, err := s.grpc.Produce(ctx, &api.ProduceRequest{
+			Record: record,
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		res.Offsets = append(res.Offsets, produce.Offset)
+	}
+	writeJSON(w, res)
+}
 
-func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
-	var req ProduceRequest
-
-	err := json.NewDecoder(r.Body).Decode(&req)
-
+// handleOffsets serves GET /offsets, the range of offsets consumers can read.
+func (s *httpServer) handleOffsets(w http.ResponseWriter, r *http.Request) {
+	if err := s.grpc.Authorizer.Authorize(
+		subject(requestContext(r)),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		writeError(w, err)
+		return
+	}
+	lowest, err := s.grpc.CommitLog.LowestOffset()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
-	off, err := s.Log.Append(req.Record)
-
+	next, err := s.grpc.next()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
+	if next < lowest {
+		next = lowest
+	}
+	writeJSON(w, &api.OffsetsResponse{Lowest: lowest, Next: next})
+}
 
-	res := ProduceResponse{Offset: off}
-	// new Necoder response to the ResponseWriter
-	err = json.NewEncoder(w).Encode(res)
+// maxWait bounds how long a consume request may wait for its record.
+const maxWait = time.Minute
 
+/*
+parseWait parses a consume request's wait parameter, how long the request
+waits for a record that isn't appended yet: a duration like 10s or a number of
+seconds. Longer waits than maxWait are cut to it.
+*/
+func parseWait(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(v)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		seconds, serr := strconv.ParseUint(v, 10, 32)
+		if serr != nil {
+			return 0, fmt.Errorf("wait must be a duration like 10s")
+		}
+		wait = time.Duration(seconds) * time.Second
 	}
+	if wait < 0 {
+		return 0, fmt.Errorf("wait can't be negative")
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	return wait, nil
 }
 
 /*
-The produce handler implements the three steps we discussed before:
-unmarshaling the request into a struct, using that struct to produce to the
-log and getting the offset that the log stored the record under, and marshaling
-and writing the result to the response
-
-The consume handler is like the produce handler but calls Read(offset uint64) to
-get the record stored in the log
+consume reads the record at offset. When the record isn't appended yet it
+waits for up to wait, failing with api.ErrOffsetOutOfRange like an immediate
+read once the wait is over, so clients that can't hold a stream open long-poll
+the log's tail.
 */
-func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
-
-	var req ConsumeRequest
+func (s *httpServer) consume(
+	ctx context.Context,
+	offset uint64,
+	wait time.Duration,
+) (*api.ConsumeResponse, error) {
+	res, err := s.tail(ctx, offset, wait)
+	if err == errNotAppended {
+		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	return res, err
+}
 
-	err := json.NewDecoder(r.Body).Decode(&req)
+// errNotAppended is the error tail fails with when the record still isn't
+// appended once the wait is over.
+var errNotAppended = errors.New("the record isn't appended yet")
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+/*
+tail reads the record at offset, polling the log every tailInterval for up to
+wait while the record isn't appended yet, and fails with errNotAppended once
+the wait is over. An offset below the log's lowest, one a truncation removed,
+fails with api.ErrOffsetOutOfRange right away instead, since its record won't
+ever be appended. The requests following the log, the long-polling consumes,
+the event stream and the WebSocket subscriptions, all read it through tail.
+*/
+func (s *httpServer) tail(
+	ctx context.Context,
+	offset uint64,
+	wait time.Duration,
+) (*api.ConsumeResponse, error) {
+	req := &api.ConsumeRequest{Offset: offset}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	ticker := time.NewTicker(tailInterval)
+	defer ticker.Stop()
+	for {
+		if s.grpc.shuttingDown() {
+			return nil, api.ErrShuttingDown{}
+		}
+		res, err := s.grpc.Consume(ctx, req)
+		if status.Code(err) != codes.Code(http.StatusNotFound) {
+			return res, err
+		}
+		lowest, lerr := s.grpc.CommitLog.LowestOffset()
+		if lerr != nil {
+			return nil, lerr
+		}
+		if offset < lowest {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.grpc.ShuttingDown:
+			return nil, api.ErrShuttingDown{}
+		case <-timeout.C:
+			return nil, errNotAppended
+		case <-ticker.C:
+		}
 	}
-	record, err := s.Log.Read(req.Offset)
+}
 
-	if err == ErrOfsetNotFound {
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
-	}
+// writeJSON writes the response as protobuf JSON, the way the gateway writes
+// its responses.
+func writeJSON(w http.ResponseWriter, res proto.Message) {
+	b, err := jsonMarshaler.Marshal(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	res := ConsumeResponse{Record: record}
-	err = json.NewEncoder(w).Encode(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// requestContext returns the request's context carrying the subject of its
+// client certificate, the way authenticate does for gRPC calls.
+func requestContext(r *http.Request) context.Context {
+	subject := ""
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		subject = r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	return context.WithValue(r.Context(), subjectContextKey{}, subject)
+}
+
+// writeError writes the status of an error the gRPC handlers returned as the
+// matching HTTP status.
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	http.Error(w, st.Message(), httpStatus(st.Code()))
+}
+
+// httpStatus returns the HTTP status matching a gRPC code.
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound, codes.Code(http.StatusNotFound):
+		// api.ErrOffsetOutOfRange's status has a code of 404
+		return http.StatusNotFound
+	case codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
 	}
+	return http.StatusInternalServerError
 }
@@ -0,0 +1,638 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+	"github.com/Franklynoble/proglog/internal/auth"
+	"github.com/Franklynoble/proglog/internal/config"
+	"github.com/Franklynoble/proglog/internal/log"
+)
+
+func TestHTTPServer(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T,
+		rootClient *http.Client,
+		nobodyClient *http.Client,
+		url string,
+		config *Config,
+	){
+		"produce/consume a record succeeds":  testHTTPProduceConsume,
+		"consume past log boundary is a 404": testHTTPConsumePastBoundary,
+		"unauthorized is a 403":              testHTTPUnauthorized,
+		"record routes page through the log": testHTTPRecords,
+		"event stream follows the log":       testHTTPStreamRecords,
+		"websocket produces and subscribes":  testWebSocket,
+		"websocket closes on shutdown":       testWebSocketShutdown,
+		"consume waits for the record":       testHTTPWait,
+		"truncated records are a 404":        testHTTPTruncated,
+		"gateway streams records as NDJSON":  testGatewayConsumeStream,
+		"health probes report the log":       testHTTPHealth,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			rootClient, nobodyClient, url, config, teardown := setupHTTPTest(t)
+			defer teardown()
+			fn(t, rootClient, nobodyClient, url, config)
+		})
+	}
+}
+
+// setupHTTPTest serves a log over HTTPS and returns clients with the root and
+// nobody certificates.
+func setupHTTPTest(t *testing.T) (
+	rootClient *http.Client,
+	nobodyClient *http.Client,
+	url string,
+	cfg *Config,
+	teardown func(),
+) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "http-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	cfg = &Config{
+		CommitLog:  clog,
+		Authorizer: auth.New(config.ACLModelFile, config.ACLPolicyFile),
+	}
+	srv, err := NewHTTPServer("", cfg)
+	require.NoError(t, err)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.ServerCertFile,
+		KeyFile:  config.ServerKeyFile,
+		CAFile:   config.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.TLS = serverTLSConfig
+	ts.StartTLS()
+
+	newClient := func(crtPath, keyPath string) *http.Client {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile: crtPath,
+			KeyFile:  keyPath,
+			CAFile:   config.CAFile,
+		})
+		require.NoError(t, err)
+		return &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+	}
+	rootClient = newClient(config.RootClientCertFile, config.RootClientKeyFile)
+	nobodyClient = newClient(
+		config.NobodyClientCertFile,
+		config.NobodyClientKeyFile,
+	)
+
+	return rootClient, nobodyClient, ts.URL, cfg, func() {
+		ts.Close()
+		clog.Remove()
+		os.RemoveAll(dir)
+	}
+}
+
+// writeWebSocket sends msg over conn as protobuf JSON.
+func writeWebSocket(conn *websocket.Conn, msg *api.WebSocketMessage) error {
+	b, err := protojson.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.TextMessage, b)
+}
+
+// readWebSocket reads the next protobuf JSON message from conn.
+func readWebSocket(conn *websocket.Conn) (*api.WebSocketMessage, error) {
+	_, b, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	msg := &api.WebSocketMessage{}
+	return msg, protojson.Unmarshal(b, msg)
+}
+
+// do sends the request as protobuf JSON and decodes the response into res if
+// it's a 200.
+func do(
+	t *testing.T,
+	client *http.Client,
+	method, url string,
+	req, res proto.Message,
+) int {
+	t.Helper()
+	var body []byte
+	if req != nil {
+		var err error
+		body, err = protojson.Marshal(req)
+		require.NoError(t, err)
+	}
+	r, err := http.NewRequest(method, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	resp, err := client.Do(r)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && res != nil {
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, protojson.Unmarshal(b, res))
+	}
+	return resp.StatusCode
+}
+
+func testHTTPProduceConsume(
+	t *testing.T,
+	client, _ *http.Client,
+	url string,
+	config *Config,
+) {
+	var produce api.ProduceResponse
+	code := do(t, client, "POST", url+"/v1/records", &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	}, &produce)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	var consume api.ConsumeResponse
+	code = do(t, client, "GET", url+"/v1/records/0", nil, &consume)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+
+	// the gRPC clients read the same log
+	record, err := config.CommitLog.Read(produce.Offset)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
+
+func testHTTPConsumePastBoundary(
+	t *testing.T,
+	client, _ *http.Client,
+	url string,
+	config *Config,
+) {
+	code := do(t, client, "GET", url+"/v1/records/1", nil, nil)
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+func testHTTPUnauthorized(
+	t *testing.T,
+	_, client *http.Client,
+	url string,
+	config *Config,
+) {
+	code := do(t, client, "POST", url+"/v1/records", &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	}, nil)
+	require.Equal(t, http.StatusForbidden, code)
+	code = do(t, client, "GET", url+"/v1/records/0", nil, nil)
+	require.Equal(t, http.StatusForbidden, code)
+	code = do(t, client, "GET", url+"/v1/records/0/stream", nil, nil)
+	require.Equal(t, http.StatusForbidden, code)
+}
+
+func testGatewayConsumeStream(
+	t *testing.T,
+	client, _ *http.Client,
+	url string,
+	config *Config,
+) {
+	for _, value := range []string{"first", "second"} {
+		_, err := config.CommitLog.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	resp, err := client.Get(url + "/v1/records/0/stream")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the stream is a JSON object a line, following the log's tail
+	lines := bufio.NewScanner(resp.Body)
+	next := func() *api.ConsumeResponse {
+		t.Helper()
+		require.True(t, lines.Scan())
+		var chunk struct {
+			Result json.RawMessage `json:"result"`
+		}
+		require.NoError(t, json.Unmarshal(lines.Bytes(), &chunk))
+		var res api.ConsumeResponse
+		require.NoError(t, protojson.Unmarshal(chunk.Result, &res))
+		return &res
+	}
+	require.Equal(t, []byte("first"), next().Record.Value)
+	require.Equal(t, []byte("second"), next().Record.Value)
+	_, err = config.CommitLog.Append(&api.Record{Value: []byte("third")})
+	require.NoError(t, err)
+	res := next()
+	require.Equal(t, []byte("third"), res.Record.Value)
+	require.Equal(t, uint64(2), res.Record.Offset)
+}
+
+func testHTTPRecords(
+	t *testing.T,
+	client, _ *http.Client,
+	url string,
+	config *Config,
+) {
+	var offsets api.OffsetsResponse
+	code := do(t, client, "GET", url+"/offsets", nil, &offsets)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, uint64(0), offsets.Lowest)
+	require.Equal(t, uint64(0), offsets.Next)
+
+	var produce api.ProduceRecordsResponse
+	code = do(t, client, "POST", url+"/records", &api.ProduceRecordsRequest{
+		Record: &api.Record{Value: []byte("first")},
+	}, &produce)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, uint64(0), *produce.Offset)
+
+	produce = api.ProduceRecordsResponse{}
+	code = do(t, client, "POST", url+"/records", &api.ProduceRecordsRequest{
+		Records: []*api.Record{
+			{Value: []byte("second")},
+			{Value: []byte("third")},
+		},
+	}, &produce)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []uint64{1, 2}, produce.Offsets)
+
+	code = do(t, client, "POST", url+"/records", &api.ProduceRecordsRequest{}, nil)
+	require.Equal(t, http.StatusBadRequest, code)
+	// a null record is no record at all
+	resp, err := client.Post(
+		url+"/records",
+		"application/json",
+		strings.NewReader(`{"record": null}`),
+	)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var consume api.ConsumeResponse
+	code = do(t, client, "GET", url+"/records/1", nil, &consume)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []byte("second"), consume.Record.Value)
+	code = do(t, client, "GET", url+"/records/3", nil, nil)
+	require.Equal(t, http.StatusNotFound, code)
+
+	var page api.ListRecordsResponse
+	code = do(t, client, "GET", url+"/records?limit=2", nil, &page)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 2, len(page.Records))
+	require.Equal(t, []byte("first"), page.Records[0].Value)
+	require.Equal(t, uint64(2), page.Next)
+
+	page = api.ListRecordsResponse{}
+	code = do(t, client, "GET", url+"/records?from=2&limit=2", nil, &page)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 1, len(page.Records))
+	require.Equal(t, []byte("third"), page.Records[0].Value)
+	require.Equal(t, uint64(3), page.Next)
+
+	code = do(t, client, "GET", url+"/records?limit=0", nil, nil)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code = do(t, client, "GET", url+"/offsets", nil, &offsets)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, uint64(0), offsets.Lowest)
+	require.Equal(t, uint64(3), offsets.Next)
+}
+
+func testHTTPStreamRecords(
+	t *testing.T,
+	client, _ *http.Client,
+	url string,
+	config *Config,
+) {
+	for _, value := range []string{"first", "second"} {
+		_, err := config.CommitLog.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+
+	// stream opens the event stream and returns the next event's ID and
+	// record
+	stream := func(path, lastEventID string) (
+		next func() (string, *api.Record),
+		stop func(),
+	) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		req, err := http.NewRequestWithContext(ctx, "GET", url+path, nil)
+		require.NoError(t, err)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		lines := bufio.NewScanner(resp.Body)
+		return func() (string, *api.Record) {
+				var id string
+				record := &api.Record{}
+				for lines.Scan() {
+					line := lines.Text()
+					switch {
+					case strings.HasPrefix(line, "id: "):
+						id = strings.TrimPrefix(line, "id: ")
+					case strings.HasPrefix(line, "data: "):
+						require.NoError(t, protojson.Unmarshal(
+							[]byte(strings.TrimPrefix(line, "data: ")),
+							record,
+						))
+					case line == "" && id != "":
+						return id, record
+					}
+				}
+				require.NoError(t, lines.Err())
+				return "", nil
+			}, func() {
+				cancel()
+				resp.Body.Close()
+			}
+	}
+
+	next, stop := stream("/records/stream?from=1", "")
+	id, record := next()
+	require.Equal(t, "1", id)
+	require.Equal(t, []byte("second"), record.Value)
+
+	// the stream follows the records appended after it started
+	_, err := config.CommitLog.Append(&api.Record{Value: []byte("third")})
+	require.NoError(t, err)
+	id, record = next()
+	require.Equal(t, "2", id)
+	require.Equal(t, []byte("third"), record.Value)
+	stop()
+
+	// a reconnecting client resumes after the last event it saw
+	next, stop = stream("/records/stream?from=0", "1")
+	defer stop()
+	id, record = next()
+	require.Equal(t, "2", id)
+	require.Equal(t, []byte("third"), record.Value)
+}
+
+func testWebSocket(
+	t *testing.T,
+	rootClient, nobodyClient *http.Client,
+	url string,
+	config *Config,
+) {
+	dial := func(client *http.Client) *websocket.Conn {
+		dialer := websocket.Dialer{
+			TLSClientConfig: client.Transport.(*http.Transport).TLSClientConfig,
+		}
+		conn, _, err := dialer.Dial(
+			"wss"+strings.TrimPrefix(url, "https")+"/ws",
+			nil,
+		)
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	read := func(conn *websocket.Conn) *api.WebSocketMessage {
+		msg, err := readWebSocket(conn)
+		require.NoError(t, err)
+		return msg
+	}
+
+	conn := dial(rootClient)
+	defer conn.Close()
+	_, err := config.CommitLog.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	from := uint64(0)
+	require.NoError(t, writeWebSocket(conn, &api.WebSocketMessage{
+		Type:   MessageSubscribe,
+		Id:     "tail",
+		Offset: &from,
+	}))
+	msg := read(conn)
+	require.Equal(t, MessageRecord, msg.Type)
+	require.Equal(t, "tail", msg.Id)
+	require.Equal(t, []byte("first"), msg.Record.Value)
+
+	// produces and the subscription share the connection
+	require.NoError(t, writeWebSocket(conn, &api.WebSocketMessage{
+		Type:   MessageProduce,
+		Id:     "second",
+		Record: &api.Record{Value: []byte("second")},
+	}))
+	got := map[string]*api.WebSocketMessage{}
+	for i := 0; i < 2; i++ {
+		msg = read(conn)
+		got[msg.Type] = msg
+	}
+	require.Equal(t, "second", got[MessageProduced].Id)
+	require.Equal(t, uint64(1), *got[MessageProduced].Offset)
+	require.Equal(t, "tail", got[MessageRecord].Id)
+	require.Equal(t, []byte("second"), got[MessageRecord].Record.Value)
+
+	require.NoError(t, writeWebSocket(conn, &api.WebSocketMessage{Type: "bogus"}))
+	msg = read(conn)
+	require.Equal(t, MessageError, msg.Type)
+	require.Equal(t, int32(http.StatusBadRequest), msg.Code)
+
+	// the nobody client may neither produce nor subscribe
+	nobody := dial(nobodyClient)
+	defer nobody.Close()
+	require.NoError(t, writeWebSocket(nobody, &api.WebSocketMessage{
+		Type:   MessageProduce,
+		Id:     "denied",
+		Record: &api.Record{Value: []byte("denied")},
+	}))
+	msg = read(nobody)
+	require.Equal(t, MessageError, msg.Type)
+	require.Equal(t, "denied", msg.Id)
+	require.Equal(t, int32(http.StatusForbidden), msg.Code)
+	require.NoError(t, writeWebSocket(nobody, &api.WebSocketMessage{
+		Type: MessageSubscribe,
+		Id:   "denied",
+	}))
+	msg = read(nobody)
+	require.Equal(t, int32(http.StatusForbidden), msg.Code)
+}
+
+func testWebSocketShutdown(
+	t *testing.T,
+	client, _ *http.Client,
+	url string,
+	config *Config,
+) {
+	shuttingDown := make(chan struct{})
+	config.ShuttingDown = shuttingDown
+	dialer := websocket.Dialer{
+		TLSClientConfig: client.Transport.(*http.Transport).TLSClientConfig,
+	}
+	wsURL := "wss" + strings.TrimPrefix(url, "https") + "/ws"
+	conn, _, err := dialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	close(shuttingDown)
+	require.NoError(t, writeWebSocket(conn, &api.WebSocketMessage{
+		Type:   MessageProduce,
+		Id:     "late",
+		Record: &api.Record{Value: []byte("late")},
+	}))
+	// the produce fails, unless the connection closed before the server
+	// read it, and the connection closes going away
+	msg, err := readWebSocket(conn)
+	if err == nil {
+		require.Equal(t, MessageError, msg.Type)
+		require.Equal(t, "late", msg.Id)
+		require.Equal(t, int32(http.StatusServiceUnavailable), msg.Code)
+		_, err = readWebSocket(conn)
+	}
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+	_, err = config.CommitLog.Read(0)
+	require.Error(t, err)
+
+	// new connections fail
+	_, resp, err := dialer.Dial(wsURL, nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func testHTTPWait(
+	t *testing.T,
+	client, _ *http.Client,
+	url string,
+	config *Config,
+) {
+	// the wait runs out without a record
+	start := time.Now()
+	code := do(t, client, "GET", url+"/records/0?wait=100ms", nil, nil)
+	require.Equal(t, http.StatusNotFound, code)
+	require.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	code = do(t, client, "GET", url+"/records/0?wait=soon", nil, nil)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		config.CommitLog.Append(&api.Record{Value: []byte("hello world")})
+	}()
+	var consume api.ConsumeResponse
+	code = do(t, client, "GET", url+"/records/0?wait=5", nil, &consume)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		config.CommitLog.Append(&api.Record{Value: []byte("second")})
+	}()
+	var page api.ListRecordsResponse
+	code = do(t, client, "GET", url+"/records?from=1&wait=5s", nil, &page)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 1, len(page.Records))
+	require.Equal(t, []byte("second"), page.Records[0].Value)
+
+	// the gateway's consume waits the same way
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		config.CommitLog.Append(&api.Record{Value: []byte("third")})
+	}()
+	consume = api.ConsumeResponse{}
+	code = do(t, client, "GET", url+"/v1/records/2?wait=5s", nil, &consume)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []byte("third"), consume.Record.Value)
+
+	code = do(t, client, "GET", url+"/v1/records/3?wait=soon", nil, nil)
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func testHTTPTruncated(
+	t *testing.T,
+	client, _ *http.Client,
+	url string,
+	config *Config,
+) {
+	clog := config.CommitLog.(*log.Log)
+	clog.Config.Segment.MaxStoreBytes = 32
+	require.NoError(t, clog.Reset())
+	for i := 0; i < 4; i++ {
+		_, err := clog.Append(&api.Record{Value: []byte("truncated")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, clog.Truncate(1))
+	lowest, err := clog.LowestOffset()
+	require.NoError(t, err)
+	require.NotEqual(t, uint64(0), lowest)
+
+	// the records below the lowest offset won't ever be appended, so the
+	// requests following the log fail rather than wait for them
+	code := do(t, client, "GET", url+"/records/0?wait=5s", nil, nil)
+	require.Equal(t, http.StatusNotFound, code)
+	code = do(t, client, "GET", url+"/records?from=0&wait=5s", nil, nil)
+	require.Equal(t, http.StatusNotFound, code)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"GET",
+		url+"/records/stream?from=0",
+		nil,
+	)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "event: error")
+
+	dialer := websocket.Dialer{
+		TLSClientConfig: client.Transport.(*http.Transport).TLSClientConfig,
+	}
+	conn, _, err := dialer.Dial("wss"+strings.TrimPrefix(url, "https")+"/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	from := uint64(0)
+	require.NoError(t, writeWebSocket(conn, &api.WebSocketMessage{
+		Type:   MessageSubscribe,
+		Id:     "truncated",
+		Offset: &from,
+	}))
+	msg, err := readWebSocket(conn)
+	require.NoError(t, err)
+	require.Equal(t, MessageError, msg.Type)
+	require.Equal(t, "truncated", msg.Id)
+	require.Equal(t, int32(http.StatusNotFound), msg.Code)
+}
+
+func testHTTPHealth(
+	t *testing.T,
+	_, client *http.Client,
+	url string,
+	config *Config,
+) {
+	code := do(t, client, "GET", url+"/healthz", nil, nil)
+	require.Equal(t, http.StatusOK, code)
+	code = do(t, client, "GET", url+"/readyz", nil, nil)
+	require.Equal(t, http.StatusOK, code)
+
+	require.NoError(t, config.CommitLog.(*log.Log).Close())
+	code = do(t, client, "GET", url+"/healthz", nil, nil)
+	require.Equal(t, http.StatusOK, code)
+	code = do(t, client, "GET", url+"/readyz", nil, nil)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+}
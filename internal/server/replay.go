@@ -0,0 +1,246 @@
+package server
+
+import (
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+)
+
+/*
+Replay streams a range of the log at the pace the records were appended,
+sped up by the request's speed multiplier, so a past incident can be re-run
+the way it happened. The client starts the replay with its first request and
+may pause and resume it with later ones; the server acknowledges both with a
+response that carries no record. Every response reports the replay's
+progress. A range reaching outside the records consumers can read fails with
+ErrOffsetOutOfRange before the replay sends anything. A replay with a start
+time and a start offset below the log's lowest starts at the lowest instead,
+since clients selecting records by time leave the offset at 0.
+*/
+func (s *grpcServer) Replay(stream api.Log_ReplayServer) error {
+	if err := s.Authorizer.Authorize(
+		subject(stream.Context()),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return err
+	}
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	start := req.GetStart()
+	if start == nil {
+		return status.Error(
+			codes.InvalidArgument,
+			"a replay must begin with a start request",
+		)
+	}
+	if start.Speed < 0 {
+		return status.Error(
+			codes.InvalidArgument,
+			"replay speed can't be negative",
+		)
+	}
+	r := &replay{
+		stream:       stream,
+		shuttingDown: s.ShuttingDown,
+		start:        start.StartOffset,
+		speed:        start.Speed,
+	}
+	if r.speed == 0 {
+		r.speed = 1
+	}
+	// the range must lie within the records consumers can read, up to the
+	// durable ones unless the server reads unsynced records
+	lowest, err := s.CommitLog.LowestOffset()
+	if err != nil {
+		return err
+	}
+	next, err := s.next()
+	if err != nil {
+		return err
+	}
+	if start.EndOffset != nil {
+		r.end = *start.EndOffset
+		if r.end >= next {
+			return api.ErrOffsetOutOfRange{Offset: r.end}
+		}
+	} else if next == lowest {
+		// an empty log replays nothing
+		return nil
+	} else {
+		r.end = next - 1
+	}
+	if start.StartTime != 0 && r.start < lowest {
+		// a replay selected by time starts at the oldest record left
+		// rather than at an offset the client didn't ask for
+		r.start = lowest
+	}
+	if r.start < lowest || r.start >= next {
+		return api.ErrOffsetOutOfRange{Offset: r.start}
+	}
+
+	// the client's pause and resume requests, true pausing the replay
+	controls := make(chan bool)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				// a client done sending leaves the replay running
+				return
+			}
+			var pause bool
+			switch req.Command.(type) {
+			case *api.ReplayRequest_Pause:
+				pause = true
+			case *api.ReplayRequest_Resume:
+			default:
+				errc <- status.Error(
+					codes.InvalidArgument,
+					"a replay can only be paused or resumed once started",
+				)
+				return
+			}
+			select {
+			case controls <- pause:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	for off := r.start; off <= r.end; off++ {
+		if s.shuttingDown() {
+			return api.ErrShuttingDown{}
+		}
+		record, err := s.read(off)
+		if err != nil {
+			return err
+		}
+		if start.StartTime != 0 && record.Timestamp < start.StartTime {
+			continue
+		}
+		if start.EndTime != 0 && record.Timestamp > start.EndTime {
+			break
+		}
+		if err = r.wait(record, controls, errc); err != nil {
+			return err
+		}
+		if r.done {
+			return nil
+		}
+		r.offset = off
+		r.sent = true
+		if err = stream.Send(&api.ReplayResponse{
+			Record:   record,
+			Progress: r.progress(),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+replay paces a replay. The first record is delivered right away and anchors
+the pace: every later record is due when as much time has passed since the
+anchor as passed between the two records' timestamps, divided by the speed.
+Resuming moves the anchor by the time the replay spent paused.
+*/
+type replay struct {
+	stream       api.Log_ReplayServer
+	shuttingDown <-chan struct{}
+	start        uint64
+	end          uint64
+	speed        float64
+
+	anchored   bool
+	anchor     time.Time
+	anchorTime int64
+	paused     bool
+	pausedAt   time.Time
+	// offset is the last offset delivered, if any was sent
+	offset uint64
+	sent   bool
+	// done is set when the client went away
+	done bool
+}
+
+// wait blocks until the record is due, handling pauses and resumes meanwhile.
+func (r *replay) wait(
+	record *api.Record,
+	controls <-chan bool,
+	errc <-chan error,
+) error {
+	if !r.anchored {
+		r.anchored = true
+		r.anchor = time.Now()
+		r.anchorTime = record.Timestamp
+	}
+	for {
+		var timeout <-chan time.Time
+		if !r.paused {
+			due := r.anchor.Add(
+				time.Duration(float64(record.Timestamp-r.anchorTime) / r.speed),
+			)
+			if time.Now().After(due) {
+				// the record is due but a pause may be waiting
+				select {
+				case pause := <-controls:
+					if err := r.control(pause); err != nil {
+						return err
+					}
+					continue
+				default:
+					return nil
+				}
+			}
+			timeout = time.After(time.Until(due))
+		}
+		select {
+		case <-timeout:
+			return nil
+		case pause := <-controls:
+			if err := r.control(pause); err != nil {
+				return err
+			}
+		case err := <-errc:
+			return err
+		case <-r.shuttingDown:
+			return api.ErrShuttingDown{}
+		case <-r.stream.Context().Done():
+			r.done = true
+			return nil
+		}
+	}
+}
+
+// control pauses or resumes the replay and acknowledges it to the client.
+func (r *replay) control(pause bool) error {
+	if pause == r.paused {
+		return nil
+	}
+	r.paused = pause
+	if pause {
+		r.pausedAt = time.Now()
+	} else {
+		r.anchor = r.anchor.Add(time.Since(r.pausedAt))
+	}
+	return r.stream.Send(&api.ReplayResponse{
+		Progress: r.progress(),
+		Paused:   r.paused,
+	})
+}
+
+// progress returns the share of the replay's offsets delivered so far.
+func (r *replay) progress() float64 {
+	if !r.sent {
+		return 0
+	}
+	return float64(r.offset-r.start+1) / float64(r.end-r.start+1)
+}
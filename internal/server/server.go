@@ -2,6 +2,11 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	//"google.golang.org/genproto/googleapis/rpc/status"
 	//grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
@@ -10,10 +15,13 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 
 	api "github.com/Franklynoble/proglog/api/v1"
+	"github.com/Franklynoble/proglog/internal/coordinator"
+	"github.com/Franklynoble/proglog/internal/log"
 )
 
 /*
@@ -24,10 +32,52 @@ factory function to create an instance of the server.
 */
 
 type Config struct {
-	CommitLog  CommitLog
-	Authorizer Authorizer
+	CommitLog   CommitLog
+	Authorizer  Authorizer
+	Coordinator GroupCoordinator
+	// Servers is the static list of the cluster's servers, this one
+	// included, that GetServers returns to clients.
+	Servers []*api.Server
+	// Primary is the primary's address when this server is a secondary. A
+	// secondary forwards the RPCs writing to the log, produces and
+	// transactions, to the primary over mTLS with PrimaryTLSConfig, usually
+	// built with config.SetupTLSConfig, or fails them with
+	// api.ErrNotPrimary when RejectWrites is set. Consumer groups stay
+	// local: a group's members join, commit and fetch their offsets on the
+	// server they consume from, whose coordinator fences them. Its
+	// connection to the primary closes once ShuttingDown is closed and the
+	// forwarded calls in flight finish.
+	Primary          string
+	PrimaryTLSConfig *tls.Config
+	RejectWrites     bool
+	// ReadUnsynced lets consumers read records above the log's durable
+	// watermark, records a crash could still lose.
+	ReadUnsynced bool
+	// Closing ShuttingDown drains the server for a shutdown: streams, like
+	// ConsumeStream subscriptions, end and new RPCs fail with
+	// api.ErrShuttingDown, while the RPCs in flight, like Produce calls,
+	// finish. The health service reports NOT_SERVING from then on.
+	ShuttingDown <-chan struct{}
+	// TransactionTimeout is how long a transaction may stay open before the
+	// server aborts it, so a producer that died mid-transaction doesn't
+	// stall read committed streams and can't end the transaction once it's
+	// back. 0 uses defaultTransactionTimeout.
+	TransactionTimeout time.Duration
+	// WebSockets, when set, counts the HTTP server's open WebSocket
+	// connections, which close once ShuttingDown is closed.
+	// http.Server.Shutdown doesn't wait for the connections its handlers
+	// took over, so a shutdown waits on WebSockets before closing the log.
+	WebSockets *sync.WaitGroup
 }
 
+// defaultTransactionTimeout is how long a transaction may stay open when the
+// config doesn't say.
+const defaultTransactionTimeout = time.Minute
+
+// tailInterval is how often a stream following the log's tail, or waiting on
+// an open transaction, checks for new records.
+const tailInterval = 50 * time.Millisecond
+
 const (
 	objectWildcard = "*"
 	produceAction  = "produce"
@@ -39,23 +89,33 @@ var _ api.LogServer = (*grpcServer)(nil)
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+	// primary is the client forwarding writes to the primary, nil once its
+	// connection closed for a shutdown.
+	primaryMu sync.RWMutex
+	primary   api.LogClient
 }
 
 func NEWGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
 
+	srv, err := newgrpcServer(config)
+	if err != nil {
+		return nil, err
+	}
 	opts = append(opts, grpc.StreamInterceptor(
 		grpc_middleware.ChainStreamServer(
 			grpc_auth.StreamServerInterceptor(authenticate),
+			srv.streamDrain,
 		)), grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
 		grpc_auth.UnaryServerInterceptor(authenticate),
+		srv.unaryDrain,
 	)))
 	gsrv := grpc.NewServer(opts...)
 
-	srv, err := newgrpcServer(config)
-	if err != nil {
-		return nil, err
-	}
 	api.RegisterLogServer(gsrv, srv)
+	grpc_health_v1.RegisterHealthServer(gsrv, &healthServer{
+		log:          config.CommitLog,
+		shuttingDown: config.ShuttingDown,
+	})
 	return gsrv, nil
 }
 
@@ -66,7 +126,33 @@ func NEWGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, err
 
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendIf(*api.Record, uint64) (uint64, error)
 	Read(uint64) (*api.Record, error)
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	Watermark() uint64
+	Checksums() ([]*api.Checksum, error)
+	Checksum(start, end uint64) ([]byte, error)
+	BeginTransaction() (uint64, error)
+	CommitTransaction(uint64) (uint64, error)
+	AbortTransaction(uint64) (uint64, error)
+	TransactionState(uint64) log.TransactionState
+	ExpiredTransactions(timeout time.Duration) []uint64
+	CommitOffset(group string, partition uint32, offset uint64) error
+	FetchOffset(group string, partition uint32) (uint64, error)
+	// Health returns why the log can't serve, nil when it can.
+	Health() error
+}
+
+// GroupCoordinator tracks the members of consumer groups and the partitions
+// of the log each member consumes.
+type GroupCoordinator interface {
+	Join(group, memberID string) (coordinator.Membership, error)
+	Heartbeat(group, memberID string) (coordinator.Membership, error)
+	Leave(group, memberID string) error
+	Validate(group, memberID string, generation uint64) error
+	Assignment(group, memberID string, generation uint64) ([]uint32, error)
+	Partition(offset uint64) uint32
 }
 
 type Authorizer interface {
@@ -77,9 +163,57 @@ func newgrpcServer(config *Config) (srv *grpcServer, err error) {
 	srv = &grpcServer{
 		Config: config,
 	}
+	if config.Primary != "" && !config.RejectWrites {
+		if config.PrimaryTLSConfig == nil {
+			return nil, fmt.Errorf(
+				"forwarding writes to %s needs a TLS config",
+				config.Primary,
+			)
+		}
+		// grpc dials lazily and reconnects to the primary as needed
+		cc, err := grpc.Dial(
+			config.Primary,
+			grpc.WithTransportCredentials(
+				credentials.NewTLS(config.PrimaryTLSConfig),
+			),
+		)
+		if err != nil {
+			return nil, err
+		}
+		srv.primary = api.NewLogClient(cc)
+		if config.ShuttingDown != nil {
+			go func() {
+				<-config.ShuttingDown
+				srv.primaryMu.Lock()
+				defer srv.primaryMu.Unlock()
+				srv.primary = nil
+				cc.Close()
+			}()
+		}
+	}
 	return srv, nil
 }
 
+/*
+forward runs a write RPC on the primary when the server is a secondary and
+reports whether it did: a secondary forwards the call, or fails it when it
+rejects writes, while the primary serves it from its own log.
+*/
+func (s *grpcServer) forward(call func(primary api.LogClient) error) (bool, error) {
+	if s.Primary == "" {
+		return false, nil
+	}
+	if s.RejectWrites {
+		return true, api.ErrNotPrimary{Primary: s.Primary}
+	}
+	s.primaryMu.RLock()
+	defer s.primaryMu.RUnlock()
+	if s.primary == nil {
+		return true, api.ErrShuttingDown{}
+	}
+	return true, call(s.primary)
+}
+
 /*
 the API you saw in log_grpc.pb.go, we need to implement the Con-
 sume() and Produce() handlers. Our gRPC layer is thin because it defers to our
@@ -98,7 +232,40 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (
 	); err != nil {
 		return nil, err
 	}
-	offset, err := s.CommitLog.Append(req.Record)
+	if req.Record == nil {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"a produce request needs a record",
+		)
+	}
+	if req.Record.Control != api.ControlType_NONE {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"control records can't be produced",
+		)
+	}
+	var res *api.ProduceResponse
+	forwarded, err := s.forward(func(primary api.LogClient) (err error) {
+		res, err = primary.Produce(ctx, req)
+		return err
+	})
+	if forwarded {
+		return res, err
+	}
+	if req.TransactionId != 0 {
+		// a producer back after its transaction timed out is fenced
+		s.abortExpired(ctx)
+	}
+	// the log dedups retried records by the producer's sequence
+	req.Record.ProducerId = req.ProducerId
+	req.Record.Sequence = req.Sequence
+	req.Record.TransactionId = req.TransactionId
+	var offset uint64
+	if req.ExpectedOffset != nil {
+		offset, err = s.CommitLog.AppendIf(req.Record, *req.ExpectedOffset)
+	} else {
+		offset, err = s.CommitLog.Append(req.Record)
+	}
 
 	if err != nil {
 		return nil, err
@@ -106,6 +273,9 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (
 	return &api.ProduceResponse{Offset: offset}, nil
 }
 
+// Consume returns the record at the request's offset whatever its
+// transaction's state: the isolation level only applies to ConsumeStream,
+// which read committed clients consume through.
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 	*api.ConsumeResponse, error) {
 
@@ -116,7 +286,7 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 	); err != nil {
 		return nil, err
 	}
-	record, err := s.CommitLog.Read(req.Offset)
+	record, err := s.read(req.Offset)
 
 	if err != nil {
 		return nil, err
@@ -124,14 +294,61 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+// read reads the record at offset, treating the records above the log's
+// durable watermark as out of range unless the server reads unsynced records.
+func (s *grpcServer) read(offset uint64) (*api.Record, error) {
+	if !s.ReadUnsynced && offset >= s.CommitLog.Watermark() {
+		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	return s.CommitLog.Read(offset)
+}
+
+// next returns the offset after the last record consumers can read.
+func (s *grpcServer) next() (uint64, error) {
+	if !s.ReadUnsynced {
+		return s.CommitLog.Watermark(), nil
+	}
+	highest, err := s.CommitLog.HighestOffset()
+	if err != nil {
+		return 0, err
+	}
+	if _, err = s.CommitLog.Read(highest); err != nil {
+		// the log is empty
+		return s.CommitLog.LowestOffset()
+	}
+	return highest + 1, nil
+}
+
+// ProduceStream appends the stream's records until the client closes it or
+// the server shuts down, finishing the append in flight first.
 func (s *grpcServer) ProduceStream(
 	stream api.Log_ProduceStreamServer,
 ) error {
+	reqs := make(chan *api.ProduceRequest)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
 
 	for {
-		req, err := stream.Recv()
-		if err != nil {
+		var req *api.ProduceRequest
+		select {
+		case <-s.ShuttingDown:
+			return api.ErrShuttingDown{}
+		case err := <-errc:
 			return err
+		case req = <-reqs:
 		}
 		res, err := s.Produce(stream.Context(), req)
 
@@ -151,20 +368,82 @@ func (s *grpcServer) ConsumeStream(
 	stream api.Log_ConsumeStreamServer,
 ) error {
 
+	if req.MemberId != "" {
+		// a member consumes its group's partitions, so it needs both
+		if req.Group == "" {
+			return status.Error(
+				codes.InvalidArgument,
+				"a member's stream needs its group",
+			)
+		}
+		if s.Coordinator == nil {
+			return status.Error(
+				codes.Unimplemented,
+				"consumer group coordination isn't enabled",
+			)
+		}
+	}
+	var committed map[uint32]uint64
+	if req.Group != "" {
+		if err := s.Authorizer.Authorize(
+			subject(stream.Context()),
+			objectWildcard,
+			consumeAction,
+		); err != nil {
+			return err
+		}
+		var err error
+		if committed, err = s.resume(req); err != nil {
+			return err
+		}
+	}
+
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
+		case <-s.ShuttingDown:
+			return api.ErrShuttingDown{}
 
 		default:
+			if req.MemberId != "" {
+				if err := s.Coordinator.Validate(
+					req.Group,
+					req.MemberId,
+					req.Generation,
+				); err != nil {
+					return err
+				}
+			}
 			res, err := s.Consume(stream.Context(), req)
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
+				s.pause(stream.Context())
 				continue
 			default:
 				return err
 			}
+			if req.MemberId != "" {
+				// skip the records of other members' partitions and the
+				// ones the member's group already committed
+				next, ok := committed[s.Coordinator.Partition(req.Offset)]
+				if !ok || req.Offset < next {
+					req.Offset++
+					continue
+				}
+			}
+			if req.Isolation == api.IsolationLevel_READ_COMMITTED {
+				visible, ready := s.committed(stream.Context(), res.Record)
+				if !ready {
+					s.pause(stream.Context())
+					continue
+				}
+				if !visible {
+					req.Offset++
+					continue
+				}
+			}
 			if err = stream.Send(res); err != nil {
 				return err
 			}
@@ -176,6 +455,363 @@ func (s *grpcServer) ConsumeStream(
 
 }
 
+// pause holds a stream retrying an offset for tailInterval, or until the
+// stream ends or the server shuts down.
+func (s *grpcServer) pause(ctx context.Context) {
+	timer := time.NewTimer(tailInterval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-s.ShuttingDown:
+	case <-timer.C:
+	}
+}
+
+func (s *grpcServer) BeginTransaction(
+	ctx context.Context,
+	req *api.BeginTransactionRequest,
+) (*api.BeginTransactionResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+	var res *api.BeginTransactionResponse
+	forwarded, err := s.forward(func(primary api.LogClient) (err error) {
+		res, err = primary.BeginTransaction(ctx, req)
+		return err
+	})
+	if forwarded {
+		return res, err
+	}
+	id, err := s.CommitLog.BeginTransaction()
+	if err != nil {
+		return nil, err
+	}
+	return &api.BeginTransactionResponse{TransactionId: id}, nil
+}
+
+func (s *grpcServer) CommitTransaction(
+	ctx context.Context,
+	req *api.EndTransactionRequest,
+) (*api.EndTransactionResponse, error) {
+	return s.endTransaction(
+		ctx,
+		req,
+		s.CommitLog.CommitTransaction,
+		api.LogClient.CommitTransaction,
+	)
+}
+
+func (s *grpcServer) AbortTransaction(
+	ctx context.Context,
+	req *api.EndTransactionRequest,
+) (*api.EndTransactionResponse, error) {
+	return s.endTransaction(
+		ctx,
+		req,
+		s.CommitLog.AbortTransaction,
+		api.LogClient.AbortTransaction,
+	)
+}
+
+// endTransaction ends the transaction with end, or on the primary with
+// forward when the server is a secondary.
+func (s *grpcServer) endTransaction(
+	ctx context.Context,
+	req *api.EndTransactionRequest,
+	end func(uint64) (uint64, error),
+	forward func(
+		api.LogClient,
+		context.Context,
+		*api.EndTransactionRequest,
+		...grpc.CallOption,
+	) (*api.EndTransactionResponse, error),
+) (*api.EndTransactionResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+	var res *api.EndTransactionResponse
+	forwarded, err := s.forward(func(primary api.LogClient) (err error) {
+		res, err = forward(primary, ctx, req)
+		return err
+	})
+	if forwarded {
+		return res, err
+	}
+	s.abortExpired(ctx)
+	offset, err := end(req.TransactionId)
+	if err != nil {
+		return nil, err
+	}
+	return &api.EndTransactionResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) CommitOffset(
+	ctx context.Context,
+	req *api.CommitOffsetRequest,
+) (*api.CommitOffsetResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.Coordinator != nil {
+		if err := s.Coordinator.Validate(
+			req.Group,
+			req.MemberId,
+			req.Generation,
+		); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.CommitLog.CommitOffset(
+		req.Group,
+		req.Partition,
+		req.Offset,
+	); err != nil {
+		return nil, err
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+func (s *grpcServer) FetchOffset(
+	ctx context.Context,
+	req *api.FetchOffsetRequest,
+) (*api.FetchOffsetResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	offset, err := s.CommitLog.FetchOffset(req.Group, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return &api.FetchOffsetResponse{Offset: offset}, nil
+}
+
+/*
+resume moves a group's stream to the group's committed offset. A member of a
+coordinated group resumes each of its partitions separately, so resume returns
+the next offset to consume per partition and starts the stream at the lowest.
+*/
+func (s *grpcServer) resume(req *api.ConsumeRequest) (map[uint32]uint64, error) {
+	partitions := []uint32{0}
+	if req.MemberId != "" {
+		var err error
+		partitions, err = s.Coordinator.Assignment(
+			req.Group,
+			req.MemberId,
+			req.Generation,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	committed := make(map[uint32]uint64, len(partitions))
+	start := req.Offset
+	for i, p := range partitions {
+		offset, err := s.CommitLog.FetchOffset(req.Group, p)
+		switch err.(type) {
+		case nil:
+		case api.ErrGroupOffsetNotFound:
+			offset = req.Offset
+		default:
+			return nil, err
+		}
+		committed[p] = offset
+		if i == 0 || offset < start {
+			start = offset
+		}
+	}
+	req.Offset = start
+	return committed, nil
+}
+
+func (s *grpcServer) JoinGroup(
+	ctx context.Context,
+	req *api.JoinGroupRequest,
+) (*api.GroupMembership, error) {
+	if err := s.authorizeGroup(ctx); err != nil {
+		return nil, err
+	}
+	m, err := s.Coordinator.Join(req.Group, req.MemberId)
+	if err != nil {
+		return nil, err
+	}
+	return membership(m), nil
+}
+
+func (s *grpcServer) Heartbeat(
+	ctx context.Context,
+	req *api.HeartbeatRequest,
+) (*api.GroupMembership, error) {
+	if err := s.authorizeGroup(ctx); err != nil {
+		return nil, err
+	}
+	m, err := s.Coordinator.Heartbeat(req.Group, req.MemberId)
+	if err != nil {
+		return nil, err
+	}
+	return membership(m), nil
+}
+
+func (s *grpcServer) LeaveGroup(
+	ctx context.Context,
+	req *api.LeaveGroupRequest,
+) (*api.LeaveGroupResponse, error) {
+	if err := s.authorizeGroup(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.Coordinator.Leave(req.Group, req.MemberId); err != nil {
+		return nil, err
+	}
+	return &api.LeaveGroupResponse{}, nil
+}
+
+// GetServers returns the cluster's servers so clients can balance their calls
+// across them.
+func (s *grpcServer) GetServers(
+	ctx context.Context,
+	req *api.GetServersRequest,
+) (*api.GetServersResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	return &api.GetServersResponse{Servers: s.Servers}, nil
+}
+
+// GetChecksums returns the checksums of the requested offset ranges, or of
+// the log's segments, so tools can check replicas hold the same records.
+func (s *grpcServer) GetChecksums(
+	ctx context.Context,
+	req *api.GetChecksumsRequest,
+) (*api.GetChecksumsResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if len(req.Ranges) == 0 {
+		checksums, err := s.CommitLog.Checksums()
+		if err != nil {
+			return nil, err
+		}
+		return &api.GetChecksumsResponse{Checksums: checksums}, nil
+	}
+	res := &api.GetChecksumsResponse{}
+	for _, r := range req.Ranges {
+		hash, err := s.CommitLog.Checksum(r.StartOffset, r.EndOffset)
+		if err != nil {
+			return nil, err
+		}
+		res.Checksums = append(res.Checksums, &api.Checksum{
+			StartOffset: r.StartOffset,
+			EndOffset:   r.EndOffset,
+			Hash:        hash,
+		})
+	}
+	return res, nil
+}
+
+func (s *grpcServer) authorizeGroup(ctx context.Context) error {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return err
+	}
+	if s.Coordinator == nil {
+		return status.Error(
+			codes.Unimplemented,
+			"consumer group coordination isn't enabled",
+		)
+	}
+	return nil
+}
+
+func membership(m coordinator.Membership) *api.GroupMembership {
+	return &api.GroupMembership{
+		MemberId:       m.MemberID,
+		Generation:     m.Generation,
+		Partitions:     m.Partitions,
+		PartitionCount: m.PartitionCount,
+	}
+}
+
+/*
+committed decides how a read committed stream treats a record. Control records
+and records of aborted transactions are skipped, while a record of an open
+transaction isn't ready: the stream waits on it so records after it aren't
+delivered ahead of the transaction's outcome, until the transaction times out
+and is aborted.
+*/
+func (s *grpcServer) committed(
+	ctx context.Context,
+	record *api.Record,
+) (visible, ready bool) {
+	if record.Control != api.ControlType_NONE {
+		return false, true
+	}
+	if record.TransactionId == 0 {
+		return true, true
+	}
+	state := s.CommitLog.TransactionState(record.TransactionId)
+	if state == log.TransactionOpen {
+		s.abortExpired(ctx)
+		state = s.CommitLog.TransactionState(record.TransactionId)
+	}
+	switch state {
+	case log.TransactionOpen:
+		return false, false
+	case log.TransactionAborted:
+		return false, true
+	default:
+		return true, true
+	}
+}
+
+/*
+abortExpired aborts the transactions open for longer than the transaction
+timeout, on the primary when the server is a secondary. A failed abort leaves
+the transaction open for the next call to try again, and one that fails
+because the transaction ended meanwhile has nothing left to do.
+*/
+func (s *grpcServer) abortExpired(ctx context.Context) {
+	timeout := s.TransactionTimeout
+	if timeout == 0 {
+		timeout = defaultTransactionTimeout
+	}
+	for _, id := range s.CommitLog.ExpiredTransactions(timeout) {
+		req := &api.EndTransactionRequest{TransactionId: id}
+		forwarded, _ := s.forward(func(primary api.LogClient) error {
+			_, err := primary.AbortTransaction(ctx, req)
+			return err
+		})
+		if !forwarded {
+			_, _ = s.CommitLog.AbortTransaction(id)
+		}
+	}
+}
+
 func authenticate(ctx context.Context) (context.Context, error) {
 	peer, ok := peer.FromContext(ctx)
 	if !ok {
@@ -195,6 +831,46 @@ func authenticate(ctx context.Context) (context.Context, error) {
 	return ctx, nil
 }
 
+// shuttingDown reports whether the server is draining for a shutdown.
+func (s *grpcServer) shuttingDown() bool {
+	select {
+	case <-s.ShuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// unaryDrain and streamDrain fail the RPCs a draining server receives, but
+// the health checks, which report the server isn't serving.
+func (s *grpcServer) unaryDrain(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if s.shuttingDown() && !isHealthCheck(info.FullMethod) {
+		return nil, api.ErrShuttingDown{}
+	}
+	return handler(ctx, req)
+}
+
+func (s *grpcServer) streamDrain(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if s.shuttingDown() && !isHealthCheck(info.FullMethod) {
+		return api.ErrShuttingDown{}
+	}
+	return handler(srv, stream)
+}
+
+func isHealthCheck(method string) bool {
+	return strings.HasPrefix(method, "/grpc.health.v1.Health/")
+}
+
 func subject(ctx context.Context) string {
 	return ctx.Value(subjectContextKey{}).(string)
 }
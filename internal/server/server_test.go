@@ -2,17 +2,20 @@ package server
 
 import (
 	"context"
+	"io"
 	"io/ioutil"
 	"net"
-	"os"
 	"testing"
+	"time"
 
 	//"github.com/cloudflare/cfssl/config"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	//"google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
 
 	// "google.golang.org/grpc/internal/credentials"
@@ -20,6 +23,7 @@ import (
 	api "github.com/Franklynoble/proglog/api/v1"
 	"github.com/Franklynoble/proglog/internal/auth"
 	"github.com/Franklynoble/proglog/internal/config"
+	"github.com/Franklynoble/proglog/internal/coordinator"
 	"github.com/Franklynoble/proglog/internal/log"
 )
 
@@ -41,6 +45,16 @@ func TestServer(t *testing.T) {
 		"produce/consume stream suceeds":                     testProduceConsumeStream,
 		"consume past log boundry fails":                     testConsumePastBoundary,
 		"unauthorized fails":                                 testUnAthorized,
+		"produce duplicate sequence returns original offset": testProduceIdempotent,
+		"read committed stream skips uncommitted records":    testReadCommitted,
+		"produce at unexpected offset fails":                 testProduceExpectedOffset,
+		"consume stream resumes from group offset":           testGroupOffsets,
+		"group members consume disjoint partitions":          testGroupMembers,
+		"member stream without its group fails":              testMemberWithoutGroup,
+		"get servers returns the static peer list":           testGetServers,
+		"replay paces records and pauses":                    testReplay,
+		"replay checks its range up front":                   testReplayRange,
+		"get checksums of ranges and segments":               testGetChecksums,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootCLient, nobodyCLient,
@@ -132,16 +146,22 @@ func setupTest(t *testing.T, fn func(*Config)) (
 
 	dir, err := ioutil.TempDir("", "server-test")
 	require.NoError(t, err)
-	defer os.RemoveAll(dir)
 
 	clog, err := log.NewLog(dir, log.Config{})
 	require.NoError(t, err)
 
 	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
 
+	groups := coordinator.New(coordinator.Config{Partitions: 2})
+
 	cfg = &Config{
-		CommitLog:  clog,
-		Authorizer: authorizer,
+		CommitLog:   clog,
+		Authorizer:  authorizer,
+		Coordinator: groups,
+		Servers: []*api.Server{
+			{Id: "0", RpcAddr: l.Addr().String(), IsLeader: true},
+			{Id: "1", RpcAddr: "127.0.0.1:0"},
+		},
 	}
 	if fn != nil {
 		fn(cfg)
@@ -160,6 +180,8 @@ func setupTest(t *testing.T, fn func(*Config)) (
 		rootConn.Close()
 		nobodyConn.Close()
 		l.Close()
+		groups.Close()
+		clog.Remove()
 	}
 	// END: teardown
 }
@@ -184,6 +206,8 @@ func testProduceConsume(t *testing.T, client, _ api.LogClient, config *Config) {
 	require.NoError(t, err)
 	require.Equal(t, want.Value, consume.Record.Value)
 	require.Equal(t, want.Offset, consume.Record.Offset)
+	_, err = client.Produce(ctx, &api.ProduceRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
 }
 
 /*
@@ -254,9 +278,11 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, config *Con
 			res, err := stream.Recv()
 
 			require.NoError(t, err)
+			require.NotZero(t, res.Record.Timestamp)
 			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
+				Value:     record.Value,
+				Offset:    uint64(i),
+				Timestamp: res.Record.Timestamp,
 			})
 		}
 	}
@@ -298,3 +324,654 @@ func testUnAthorized(
 	}
 
 }
+
+func testProduceIdempotent(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	req := &api.ProduceRequest{
+		Record: &api.Record{
+			Value: []byte("hello world"),
+		},
+		ProducerId: "producer",
+		Sequence:   7,
+	}
+	first, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+
+	retry, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, first.Offset, retry.Offset)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset: first.Offset + 1,
+	})
+	got := grpc.Code(err)
+	want := grpc.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
+	require.Equal(t, want, got)
+}
+
+func testReadCommitted(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	produce := func(value string, txn uint64) {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record:        &api.Record{Value: []byte(value)},
+			TransactionId: txn,
+		})
+		require.NoError(t, err)
+	}
+
+	committed, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.NoError(t, err)
+	produce("committed", committed.TransactionId)
+	produce("plain", 0)
+
+	aborted, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.NoError(t, err)
+	produce("aborted", aborted.TransactionId)
+	_, err = client.AbortTransaction(ctx, &api.EndTransactionRequest{
+		TransactionId: aborted.TransactionId,
+	})
+	require.NoError(t, err)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:    0,
+		Isolation: api.IsolationLevel_READ_COMMITTED,
+	})
+	require.NoError(t, err)
+
+	_, err = client.CommitTransaction(ctx, &api.EndTransactionRequest{
+		TransactionId: committed.TransactionId,
+	})
+	require.NoError(t, err)
+	produce("after", 0)
+
+	for _, want := range []string{"committed", "plain", "after"} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, string(res.Record.Value))
+	}
+}
+
+// TestTransactionTimeout checks an abandoned transaction is aborted once it
+// times out, rather than stalling read committed streams for good.
+func TestTransactionTimeout(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(config *Config) {
+		config.TransactionTimeout = 100 * time.Millisecond
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	abandoned, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:        &api.Record{Value: []byte("abandoned")},
+		TransactionId: abandoned.TransactionId,
+	})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("plain")},
+	})
+	require.NoError(t, err)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Isolation: api.IsolationLevel_READ_COMMITTED,
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "plain", string(res.Record.Value))
+
+	// the producer can't add to or commit the transaction once it's back
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:        &api.Record{Value: []byte("late")},
+		TransactionId: abandoned.TransactionId,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = client.CommitTransaction(ctx, &api.EndTransactionRequest{
+		TransactionId: abandoned.TransactionId,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func testProduceExpectedOffset(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	expected := uint64(0)
+	req := &api.ProduceRequest{
+		Record: &api.Record{
+			Value: []byte("hello world"),
+		},
+		ExpectedOffset: &expected,
+	}
+	produce, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, expected, produce.Offset)
+
+	produce, err = client.Produce(ctx, req)
+	require.Nil(t, produce)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func testGroupOffsets(t *testing.T, client, nobody api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	for _, value := range []string{"first", "second"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+	}
+
+	_, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "group"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:  "group",
+		Offset: 1,
+	})
+	require.NoError(t, err)
+
+	fetch, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "group"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), fetch.Offset)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Group: "group"})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "second", string(res.Record.Value))
+
+	_, err = nobody.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "group"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testGroupMembers(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	a, err := client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "group"})
+	require.NoError(t, err)
+	b, err := client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "group"})
+	require.NoError(t, err)
+	a, err = client.Heartbeat(ctx, &api.HeartbeatRequest{
+		Group:    "group",
+		MemberId: a.MemberId,
+	})
+	require.NoError(t, err)
+	require.Equal(t, b.Generation, a.Generation)
+	require.Len(t, a.Partitions, 1)
+	require.Len(t, b.Partitions, 1)
+
+	// a already consumed its partition's first record
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:      "group",
+		MemberId:   a.MemberId,
+		Generation: a.Generation,
+		Partition:  a.Partitions[0],
+		Offset:     uint64(a.Partitions[0] + a.PartitionCount),
+	})
+	require.NoError(t, err)
+
+	for _, m := range []*api.GroupMembership{a, b} {
+		stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+			Group:      "group",
+			MemberId:   m.MemberId,
+			Generation: m.Generation,
+		})
+		require.NoError(t, err)
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, m.Partitions[0], uint32(res.Record.Offset%uint64(m.PartitionCount)))
+		if m == a {
+			require.Equal(t, uint64(a.Partitions[0]+a.PartitionCount), res.Record.Offset)
+		}
+	}
+
+	_, err = client.LeaveGroup(ctx, &api.LeaveGroupRequest{
+		Group:    "group",
+		MemberId: b.MemberId,
+	})
+	require.NoError(t, err)
+
+	// a is fenced until it picks up the new generation
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:      "group",
+		MemberId:   a.MemberId,
+		Generation: a.Generation,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func testMemberWithoutGroup(t *testing.T, client, _ api.LogClient, config *Config) {
+	stream, err := client.ConsumeStream(
+		context.Background(),
+		&api.ConsumeRequest{MemberId: "member"},
+	)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// TestMemberWithoutCoordinator checks a server without a coordinator fails a
+// member's stream rather than panicking.
+func TestMemberWithoutCoordinator(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(config *Config) {
+		config.Coordinator = nil
+	})
+	defer teardown()
+
+	stream, err := client.ConsumeStream(
+		context.Background(),
+		&api.ConsumeRequest{Group: "group", MemberId: "member"},
+	)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func testGetServers(t *testing.T, client, nobody api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res.Servers))
+	require.Equal(t, "0", res.Servers[0].Id)
+	require.Equal(t, config.Servers[0].RpcAddr, res.Servers[0].RpcAddr)
+	require.True(t, res.Servers[0].IsLeader)
+	require.False(t, res.Servers[1].IsLeader)
+
+	_, err = nobody.GetServers(ctx, &api.GetServersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+/*
+TestSecondary runs a secondary in front of a primary and checks the secondary
+forwards writes to the primary, or when it rejects writes, fails them with the
+primary's address in the error details, while serving consumer groups itself.
+*/
+func TestSecondary(t *testing.T) {
+	primaryClient, _, primaryConfig, teardown := setupTest(t, nil)
+	defer teardown()
+	primary := primaryConfig.Servers[0].RpcAddr
+
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.RootClientCertFile,
+		KeyFile:  config.RootClientKeyFile,
+		CAFile:   config.CAFile,
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	client, _, cfg, teardown := setupTest(t, func(c *Config) {
+		c.Primary = primary
+		c.PrimaryTLSConfig = tlsConfig
+	})
+	defer teardown()
+	primaryLog := primaryConfig.CommitLog
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	consume, err := primaryClient.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+	_, err = cfg.CommitLog.Read(produce.Offset)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("second")},
+	}))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset+1, res.Offset)
+
+	// transactions are writes too
+	begin, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.NoError(t, err)
+	require.Equal(t, log.TransactionOpen, primaryLog.TransactionState(begin.TransactionId))
+	_, err = client.CommitTransaction(ctx, &api.EndTransactionRequest{
+		TransactionId: begin.TransactionId,
+	})
+	require.NoError(t, err)
+	require.Equal(t, log.TransactionCommitted, primaryLog.TransactionState(begin.TransactionId))
+
+	// while the group offsets committed through the secondary stay there,
+	// with the secondary's coordinator fencing its members
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:  "group",
+		Offset: 1,
+	})
+	require.NoError(t, err)
+	fetch, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{
+		Group: "group",
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), fetch.Offset)
+
+	client, _, _, teardown = setupTest(t, func(c *Config) {
+		c.Primary = primary
+		c.RejectWrites = true
+	})
+	defer teardown()
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	st := status.Convert(err)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+	var info *errdetails.ErrorInfo
+	for _, d := range st.Details() {
+		if i, ok := d.(*errdetails.ErrorInfo); ok {
+			info = i
+		}
+	}
+	require.NotNil(t, info)
+	require.Equal(t, primary, info.Metadata["primary"])
+
+	_, err = client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+// TestSecondaryShutdown checks a secondary closes its connection to the
+// primary once it shuts down.
+func TestSecondaryShutdown(t *testing.T) {
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.RootClientCertFile,
+		KeyFile:  config.RootClientKeyFile,
+		CAFile:   config.CAFile,
+	})
+	require.NoError(t, err)
+	shuttingDown := make(chan struct{})
+	srv, err := newgrpcServer(&Config{
+		Primary:          "127.0.0.1:0",
+		PrimaryTLSConfig: tlsConfig,
+		ShuttingDown:     shuttingDown,
+	})
+	require.NoError(t, err)
+
+	close(shuttingDown)
+	require.Eventually(t, func() bool {
+		srv.primaryMu.RLock()
+		defer srv.primaryMu.RUnlock()
+		return srv.primary == nil
+	}, time.Second, 10*time.Millisecond)
+	_, err = srv.forward(func(api.LogClient) error { return nil })
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func testReplay(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	// records 200ms apart, the second one before the replay's start time
+	base := time.Now().Add(-time.Hour).UnixNano()
+	for i := 0; i < 4; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value:     []byte("hello world"),
+				Timestamp: base + int64(i)*int64(200*time.Millisecond),
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	stream, err := client.Replay(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ReplayRequest{
+		Command: &api.ReplayRequest_Start{Start: &api.ReplayStart{
+			StartOffset: 1,
+			StartTime:   base + int64(300*time.Millisecond),
+			Speed:       2,
+		}},
+	}))
+	begin := time.Now()
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Record.Offset)
+	require.Equal(t, float64(2)/3, res.Progress)
+
+	require.NoError(t, stream.Send(&api.ReplayRequest{
+		Command: &api.ReplayRequest_Pause{Pause: &api.ReplayPause{}},
+	}))
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.True(t, res.Paused)
+	require.Nil(t, res.Record)
+	time.Sleep(200 * time.Millisecond)
+	require.NoError(t, stream.Send(&api.ReplayRequest{
+		Command: &api.ReplayRequest_Resume{Resume: &api.ReplayResume{}},
+	}))
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.False(t, res.Paused)
+
+	// 200ms between the records at twice the pace, after a 200ms pause
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Record.Offset)
+	require.Equal(t, float64(1), res.Progress)
+	require.True(t, time.Since(begin) >= 300*time.Millisecond)
+
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+func testReplayRange(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	replay := func(start uint64, end *uint64) error {
+		stream, err := client.Replay(ctx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&api.ReplayRequest{
+			Command: &api.ReplayRequest_Start{Start: &api.ReplayStart{
+				StartOffset: start,
+				EndOffset:   end,
+			}},
+		}))
+		_, err = stream.Recv()
+		return err
+	}
+
+	// an empty log replays nothing
+	require.Equal(t, io.EOF, replay(0, nil))
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	// the range must end within the log and start within the range
+	want := api.ErrOffsetOutOfRange{Offset: 1}.GRPCStatus().Message()
+	end := uint64(1)
+	require.Equal(t, want, status.Convert(replay(0, &end)).Message())
+	require.Equal(t, want, status.Convert(replay(1, nil)).Message())
+
+	// a replay selected by time alone starts at a truncated log's lowest
+	// offset
+	clog := config.CommitLog.(*log.Log)
+	clog.Config.Segment.MaxStoreBytes = 32
+	require.NoError(t, clog.Reset())
+	for i := 0; i < 4; i++ {
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, clog.Truncate(1))
+	lowest, err := clog.LowestOffset()
+	require.NoError(t, err)
+	require.NotZero(t, lowest)
+	stream, err := client.Replay(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ReplayRequest{
+		Command: &api.ReplayRequest_Start{Start: &api.ReplayStart{
+			StartTime: 1,
+		}},
+	}))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, lowest, res.Record.Offset)
+}
+
+// TestWatermark checks consumers don't get records until the log synced them.
+func TestWatermark(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watermark-test")
+	require.NoError(t, err)
+	c := log.Config{}
+	c.Durability.SyncInterval = time.Hour
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Remove()
+
+	client, _, _, teardown := setupTest(t, func(config *Config) {
+		config.CommitLog = clog
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	want := status.Code(api.ErrOffsetOutOfRange{Offset: produce.Offset})
+	require.Equal(t, want, status.Code(err))
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, clog.Sync())
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+}
+
+func testGetChecksums(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	segments, err := client.GetChecksums(ctx, &api.GetChecksumsRequest{})
+	require.NoError(t, err)
+	require.NotEmpty(t, segments.Checksums)
+	first := segments.Checksums[0]
+
+	res, err := client.GetChecksums(ctx, &api.GetChecksumsRequest{
+		Ranges: []*api.OffsetRange{{
+			StartOffset: first.StartOffset,
+			EndOffset:   first.EndOffset,
+		}, {
+			StartOffset: 0,
+			EndOffset:   3,
+		}},
+	})
+	require.NoError(t, err)
+	require.Len(t, res.Checksums, 2)
+	require.Equal(t, first.Hash, res.Checksums[0].Hash)
+	require.Equal(t, uint64(3), res.Checksums[1].EndOffset)
+}
+
+func TestHealth(t *testing.T) {
+	_, _, cfg, teardown := setupTest(t, nil)
+	defer teardown()
+
+	// any client the CA signed may probe the server's health
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.NobodyClientCertFile,
+		KeyFile:  config.NobodyClientKeyFile,
+		CAFile:   config.CAFile,
+	})
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		cfg.Servers[0].RpcAddr,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+
+	ctx := context.Background()
+	for _, service := range []string{"", "log.v1.Log"} {
+		res, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{
+			Service: service,
+		})
+		require.NoError(t, err)
+		require.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, res.Status)
+	}
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{
+		Service: "log.v1.Nope",
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	watch, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	require.NoError(t, err)
+	res, err := watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, res.Status)
+
+	// a closed log can't serve
+	require.NoError(t, cfg.CommitLog.(*log.Log).Close())
+	res, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, res.Status)
+	res, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, res.Status)
+}
+
+func TestShuttingDown(t *testing.T) {
+	shuttingDown := make(chan struct{})
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.ShuttingDown = shuttingDown
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+
+	// the subscriber waiting for the next record is told the server is
+	// going away, and so are new calls
+	close(shuttingDown)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	var reason string
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			reason = info.Reason
+		}
+	}
+	require.Equal(t, "SHUTTING_DOWN", reason)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("too late")},
+	})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+// keepAliveInterval is how often an idle event stream sends a comment so
+// proxies don't close it.
+const keepAliveInterval = 15 * time.Second
+
+/*
+handleStreamRecords serves GET /records/stream?from= as Server-Sent Events:
+every record from the from offset on is an event whose ID is the record's
+offset and whose data is the record as protobuf JSON, and the stream follows the tail
+of the log as records are appended. A client reconnecting with the
+Last-Event-ID header, as browsers' EventSource do, resumes after that record.
+*/
+func (s *httpServer) handleStreamRecords(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	ctx := requestContext(r)
+	if err := s.grpc.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		writeError(w, err)
+		return
+	}
+	var offset uint64
+	var err error
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		if offset, err = strconv.ParseUint(id, 10, 64); err != nil {
+			http.Error(w, "Last-Event-ID must be an offset", http.StatusBadRequest)
+			return
+		}
+		offset++
+	} else if from := r.URL.Query().Get("from"); from != "" {
+		if offset, err = strconv.ParseUint(from, 10, 64); err != nil {
+			http.Error(w, "from must be an offset", http.StatusBadRequest)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		// an idle stream sends a comment every keepAliveInterval
+		res, err := s.tail(ctx, offset, keepAliveInterval)
+		switch {
+		case err == nil:
+			b, err := jsonMarshaler.Marshal(res.Record)
+			if err != nil {
+				return
+			}
+			if _, err = fmt.Fprintf(
+				w,
+				"id: %d\nevent: record\ndata: %s\n\n",
+				offset, b,
+			); err != nil {
+				return
+			}
+			offset++
+		case err == errNotAppended:
+			if _, err = fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case ctx.Err() != nil:
+			return
+		default:
+			// the status line is sent, so the error ends the stream
+			// as an event
+			fmt.Fprintf(
+				w,
+				"event: error\ndata: %s\n\n",
+				status.Convert(err).Message(),
+			)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+)
+
+// The types of WebSocket messages.
+const (
+	// clients send produce, subscribe and unsubscribe messages
+	MessageProduce     = "produce"
+	MessageSubscribe   = "subscribe"
+	MessageUnsubscribe = "unsubscribe"
+	// the server answers with produced, record and error messages
+	MessageProduced = "produced"
+	MessageRecord   = "record"
+	MessageError    = "error"
+)
+
+// pingInterval is how often the server pings an idle WebSocket client, which
+// must answer within pongWait, and writeWait bounds how long a write to a
+// client may take.
+const (
+	pingInterval = 30 * time.Second
+	pongWait     = 2 * pingInterval
+	writeWait    = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{}
+
+/*
+handleWebSocket serves GET /ws, multiplexing produces and subscriptions over
+one WebSocket whose messages are api.WebSocketMessages as protobuf JSON. A
+client produces a record with a produce message carrying the record, which the
+server answers with a produced message carrying its offset. A subscribe
+message starts streaming the records from its offset on, following the log's
+tail, as record messages until the client unsubscribes. The ID is the
+client's: the server's answers carry the ID of the produce or subscribe
+message they answer, so a client can have many of both going at once. Errors
+carry the HTTP status a request with the same problem gets.
+
+When the server shuts down the connection closes with a going away close
+message, and the server's WebSockets wait group waits for its subscriptions
+and produces to end.
+*/
+func (s *httpServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if ws := s.grpc.WebSockets; ws != nil {
+		ws.Add(1)
+		defer ws.Done()
+	}
+	if s.grpc.shuttingDown() {
+		writeError(w, api.ErrShuttingDown{})
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade replied to the client already
+		return
+	}
+	ctx, cancel := context.WithCancel(requestContext(r))
+	c := &wsConn{
+		conn:          conn,
+		srv:           s,
+		ctx:           ctx,
+		subscriptions: make(map[string]*subscription),
+	}
+	defer func() {
+		cancel()
+		c.wg.Wait()
+		conn.Close()
+	}()
+	go c.ping()
+	go c.drain()
+	c.read()
+}
+
+// wsConn is a WebSocket connection's state.
+type wsConn struct {
+	conn *websocket.Conn
+	srv  *httpServer
+	// ctx carries the client's subject and ends with the connection
+	ctx context.Context
+	wg  sync.WaitGroup
+
+	// writeMu serializes writes, the connection allows one writer at a
+	// time
+	writeMu sync.Mutex
+
+	mu            sync.Mutex
+	subscriptions map[string]*subscription
+}
+
+type subscription struct {
+	cancel context.CancelFunc
+}
+
+// read handles the client's messages until the connection fails or closes.
+func (c *wsConn) read() {
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		_, b, err := c.conn.ReadMessage()
+		if err != nil {
+			// the connection closed or failed
+			return
+		}
+		msg := &api.WebSocketMessage{}
+		if err = jsonMarshaler.Unmarshal(b, msg); err != nil {
+			c.writeError(msg.Id, status.Error(
+				codes.InvalidArgument,
+				err.Error(),
+			))
+			continue
+		}
+		switch msg.Type {
+		case MessageProduce:
+			c.produce(msg)
+		case MessageSubscribe:
+			c.subscribe(msg)
+		case MessageUnsubscribe:
+			c.unsubscribe(msg.Id)
+		default:
+			c.writeError(msg.Id, status.Errorf(
+				codes.InvalidArgument,
+				"unknown message type %q",
+				msg.Type,
+			))
+		}
+	}
+}
+
+func (c *wsConn) produce(msg *api.WebSocketMessage) {
+	if c.srv.grpc.shuttingDown() {
+		c.writeError(msg.Id, api.ErrShuttingDown{})
+		return
+	}
+	if msg.Record == nil {
+		c.writeError(msg.Id, status.Error(
+			codes.InvalidArgument,
+			"a produce message needs a record",
+		))
+		return
+	}
+	res, err := c.srv.grpc.Produce(c.ctx, &api.ProduceRequest{Record: msg.Record})
+	if err != nil {
+		c.writeError(msg.Id, err)
+		return
+	}
+	c.write(&api.WebSocketMessage{
+		Type:   MessageProduced,
+		Id:     msg.Id,
+		Offset: &res.Offset,
+	})
+}
+
+/*
+subscribe starts sending the records from the message's offset on. The
+subscription ends with the connection, when the client unsubscribes, when the
+server shuts down or when a read fails for another reason than the record not
+being appended yet, like its offset being below the log's lowest.
+*/
+func (c *wsConn) subscribe(msg *api.WebSocketMessage) {
+	if err := c.srv.grpc.Authorizer.Authorize(
+		subject(c.ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		c.writeError(msg.Id, err)
+		return
+	}
+	c.mu.Lock()
+	if _, ok := c.subscriptions[msg.Id]; ok {
+		c.mu.Unlock()
+		c.writeError(msg.Id, status.Errorf(
+			codes.AlreadyExists,
+			"subscription %q exists already",
+			msg.Id,
+		))
+		return
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	sub := &subscription{cancel: cancel}
+	c.subscriptions[msg.Id] = sub
+	c.mu.Unlock()
+
+	var offset uint64
+	if msg.Offset != nil {
+		offset = *msg.Offset
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer c.remove(msg.Id, sub)
+		for {
+			res, err := c.srv.tail(ctx, offset, maxWait)
+			switch {
+			case err == nil:
+				if err = c.write(&api.WebSocketMessage{
+					Type:   MessageRecord,
+					Id:     msg.Id,
+					Record: res.Record,
+				}); err != nil {
+					return
+				}
+				offset++
+			case err == errNotAppended:
+				// keep waiting
+			case ctx.Err() != nil:
+				return
+			default:
+				c.writeError(msg.Id, err)
+				return
+			}
+		}
+	}()
+}
+
+func (c *wsConn) unsubscribe(id string) {
+	c.mu.Lock()
+	sub := c.subscriptions[id]
+	c.mu.Unlock()
+	if sub != nil {
+		c.remove(id, sub)
+	}
+}
+
+// remove ends the subscription unless the client reused its ID for a new
+// subscription already.
+func (c *wsConn) remove(id string, sub *subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sub.cancel()
+	if c.subscriptions[id] == sub {
+		delete(c.subscriptions, id)
+	}
+}
+
+// ping pings the client until the connection ends, so a client that went away
+// without closing the connection doesn't keep its subscriptions going.
+func (c *wsConn) ping() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.writeMu.Lock()
+			err := c.conn.WriteControl(
+				websocket.PingMessage,
+				nil,
+				time.Now().Add(writeWait),
+			)
+			c.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// drain closes the connection once the server starts shutting down, which
+// ends the read loop and with it the connection's subscriptions.
+func (c *wsConn) drain() {
+	select {
+	case <-c.ctx.Done():
+		return
+	case <-c.srv.grpc.ShuttingDown:
+	}
+	c.writeMu.Lock()
+	c.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(
+			websocket.CloseGoingAway,
+			"the server is shutting down",
+		),
+		time.Now().Add(writeWait),
+	)
+	c.writeMu.Unlock()
+	c.conn.Close()
+}
+
+func (c *wsConn) write(msg *api.WebSocketMessage) error {
+	b, err := jsonMarshaler.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+// writeError sends the error as an error message with the HTTP status
+// writeError would reply with.
+func (c *wsConn) writeError(id string, err error) {
+	st := status.Convert(err)
+	c.write(&api.WebSocketMessage{
+		Type:    MessageError,
+		Id:      id,
+		Code:    int32(httpStatus(st.Code())),
+		Message: st.Message(),
+	})
+}
@@ -0,0 +1,92 @@
+package verify
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+	"github.com/Franklynoble/proglog/internal/log"
+)
+
+// RepairResult is the outcome of repairing a local log from a reference
+// server.
+type RepairResult struct {
+	// Truncated is set when the local log diverged and lost its records
+	// from Offset on.
+	Truncated bool
+	Offset    uint64
+	// Fetched counts the records copied from the reference.
+	Fetched uint64
+}
+
+/*
+Repair brings a local log back in line with the reference server's. It finds
+the first offset the two diverge at the way Compare does, truncates the local
+log there and consumes only the records it's missing from the reference,
+rather than resetting the log and replaying all of it. A local log that's
+ahead of the reference is truncated to the reference's end, so it holds
+exactly the reference's records.
+
+The local log must not be served while it's repaired.
+*/
+func Repair(
+	ctx context.Context,
+	local *log.Log,
+	reference api.LogClient,
+) (RepairResult, error) {
+	var result RepairResult
+	compared, err := Compare(ctx, Client(reference), Log(local))
+	if err != nil {
+		return result, err
+	}
+	switch {
+	case compared.Diverged:
+		result.Truncated = true
+		result.Offset = compared.Offset
+	case compared.ReplicaEnd > compared.ReferenceEnd:
+		result.Truncated = true
+		result.Offset = compared.ReferenceEnd
+	}
+	if result.Truncated {
+		if err = local.TruncateFrom(result.Offset); err != nil {
+			return result, err
+		}
+	}
+
+	// the last segment's checksum ends at the log's next offset
+	segments, err := local.Checksums()
+	if err != nil {
+		return result, err
+	}
+	next := segments[len(segments)-1].EndOffset
+	if next < compared.Start {
+		return result, fmt.Errorf(
+			"reference no longer holds offsets %d to %d",
+			next, compared.Start-1,
+		)
+	}
+	for {
+		res, err := reference.Consume(ctx, &api.ConsumeRequest{Offset: next})
+		if status.Code(err) == codes.Code(404) {
+			// the reference has no more records
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		if res.Record.Offset != next {
+			return result, fmt.Errorf(
+				"reference returned offset %d, want %d",
+				res.Record.Offset, next,
+			)
+		}
+		if _, err = local.Replicate(res.Record); err != nil {
+			return result, err
+		}
+		result.Fetched++
+		next++
+	}
+}
@@ -0,0 +1,126 @@
+package verify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+	"github.com/Franklynoble/proglog/internal/log"
+)
+
+func TestRepair(t *testing.T) {
+	reference := newLog(t, 64)
+	local := newLog(t, 256)
+	for i := 0; i < 10; i++ {
+		for _, l := range []*log.Log{reference, local} {
+			_, err := l.Append(&api.Record{
+				Value:     []byte("hello world"),
+				Timestamp: int64(i + 1),
+			})
+			require.NoError(t, err)
+		}
+	}
+	for i := 10; i < 15; i++ {
+		_, err := reference.Append(&api.Record{
+			Value:     []byte("reference"),
+			Timestamp: int64(i + 1),
+		})
+		require.NoError(t, err)
+	}
+	for i := 10; i < 12; i++ {
+		_, err := local.Append(&api.Record{
+			Value:     []byte("local"),
+			Timestamp: int64(i + 1),
+		})
+		require.NoError(t, err)
+	}
+	ctx := context.Background()
+	client := &logClient{log: reference}
+
+	result, err := Repair(ctx, local, client)
+	require.NoError(t, err)
+	require.Equal(t, RepairResult{
+		Truncated: true,
+		Offset:    10,
+		Fetched:   5,
+	}, result)
+	for off := uint64(0); off < 15; off++ {
+		want, err := reference.Read(off)
+		require.NoError(t, err)
+		got, err := local.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, want.Timestamp, got.Timestamp)
+	}
+	_, err = local.Read(15)
+	require.Error(t, err)
+
+	compared, err := Compare(ctx, Log(reference), Log(local))
+	require.NoError(t, err)
+	require.False(t, compared.Diverged)
+	require.Equal(t, uint64(15), compared.End)
+
+	// a second repair has nothing left to do
+	result, err = Repair(ctx, local, client)
+	require.NoError(t, err)
+	require.Equal(t, RepairResult{}, result)
+}
+
+func TestRepairAhead(t *testing.T) {
+	reference := newLog(t, 64)
+	local := newLog(t, 256)
+	for i := uint64(0); i < 10; i++ {
+		_, err := reference.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	replicate(t, reference, local, 0, 10)
+	for i := 0; i < 2; i++ {
+		_, err := local.Append(&api.Record{Value: []byte("local")})
+		require.NoError(t, err)
+	}
+	ctx := context.Background()
+
+	// the local records past the reference's end go
+	result, err := Repair(ctx, local, &logClient{log: reference})
+	require.NoError(t, err)
+	require.Equal(t, RepairResult{Truncated: true, Offset: 10}, result)
+	_, err = local.Read(10)
+	require.Error(t, err)
+	compared, err := Compare(ctx, Log(reference), Log(local))
+	require.NoError(t, err)
+	require.Equal(t, compared.ReferenceEnd, compared.ReplicaEnd)
+}
+
+// logClient serves the calls Repair makes from a local log, the way a
+// server holding the log would.
+type logClient struct {
+	api.LogClient
+	log *log.Log
+}
+
+func (c *logClient) GetChecksums(
+	ctx context.Context,
+	req *api.GetChecksumsRequest,
+	opts ...grpc.CallOption,
+) (*api.GetChecksumsResponse, error) {
+	checksums, err := Log(c.log).Checksums(ctx, req.Ranges)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetChecksumsResponse{Checksums: checksums}, nil
+}
+
+func (c *logClient) Consume(
+	ctx context.Context,
+	req *api.ConsumeRequest,
+	opts ...grpc.CallOption,
+) (*api.ConsumeResponse, error) {
+	record, err := c.log.Read(req.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ConsumeResponse{Record: record}, nil
+}
@@ -0,0 +1,202 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+	"github.com/Franklynoble/proglog/internal/log"
+)
+
+/*
+Source is a copy of a log to check. Checksums returns the checksums of the
+given offset ranges, or of the copy's segments when ranges is empty, the way
+the GetChecksums RPC does.
+*/
+type Source interface {
+	Checksums(ctx context.Context, ranges []*api.OffsetRange) ([]*api.Checksum, error)
+}
+
+// Client returns a Source checking the log of the server client calls.
+func Client(client api.LogClient) Source {
+	return &clientSource{client}
+}
+
+type clientSource struct {
+	client api.LogClient
+}
+
+func (s *clientSource) Checksums(
+	ctx context.Context,
+	ranges []*api.OffsetRange,
+) ([]*api.Checksum, error) {
+	res, err := s.client.GetChecksums(ctx, &api.GetChecksumsRequest{
+		Ranges: ranges,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Checksums, nil
+}
+
+// Log returns a Source checking a local log.
+func Log(l *log.Log) Source {
+	return &logSource{l}
+}
+
+type logSource struct {
+	log *log.Log
+}
+
+func (s *logSource) Checksums(
+	ctx context.Context,
+	ranges []*api.OffsetRange,
+) ([]*api.Checksum, error) {
+	if len(ranges) == 0 {
+		return s.log.Checksums()
+	}
+	var checksums []*api.Checksum
+	for _, r := range ranges {
+		hash, err := s.log.Checksum(r.StartOffset, r.EndOffset)
+		if err != nil {
+			return nil, err
+		}
+		checksums = append(checksums, &api.Checksum{
+			StartOffset: r.StartOffset,
+			EndOffset:   r.EndOffset,
+			Hash:        hash,
+		})
+	}
+	return checksums, nil
+}
+
+// Result is the outcome of comparing a replica with a reference copy.
+type Result struct {
+	// ReferenceEnd and ReplicaEnd are the copies' next offsets.
+	ReferenceEnd, ReplicaEnd uint64
+	// Start and End bound the offsets both copies hold, End excluded.
+	Start, End uint64
+	// Diverged is set when the copies hold different records, Offset
+	// being the first offset they differ at.
+	Diverged bool
+	Offset   uint64
+}
+
+/*
+Compare checks the records the replica and the reference both hold. It
+compares them range by range, each range one of the reference's segments, and
+bisects the first range that differs down to the first divergent offset, so
+only the checksums travel between the copies.
+*/
+func Compare(ctx context.Context, reference, replica Source) (Result, error) {
+	var result Result
+	refSegments, err := reference.Checksums(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	repSegments, err := replica.Checksums(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	if len(refSegments) == 0 || len(repSegments) == 0 {
+		return result, nil
+	}
+	result.ReferenceEnd = refSegments[len(refSegments)-1].EndOffset
+	result.ReplicaEnd = repSegments[len(repSegments)-1].EndOffset
+	result.Start = max(refSegments[0].StartOffset, repSegments[0].StartOffset)
+	result.End = min(result.ReferenceEnd, result.ReplicaEnd)
+	if result.Start >= result.End {
+		result.End = result.Start
+		return result, nil
+	}
+
+	var ranges []*api.OffsetRange
+	for _, s := range refSegments {
+		start := max(s.StartOffset, result.Start)
+		end := min(s.EndOffset, result.End)
+		if start < end {
+			ranges = append(ranges, &api.OffsetRange{
+				StartOffset: start,
+				EndOffset:   end,
+			})
+		}
+	}
+	for _, r := range ranges {
+		same, err := matches(ctx, reference, replica, r)
+		if err != nil {
+			return result, err
+		}
+		if same {
+			continue
+		}
+		result.Diverged = true
+		result.Offset, err = bisect(ctx, reference, replica, r)
+		return result, err
+	}
+	return result, nil
+}
+
+// bisect narrows a range the copies differ on down to its first offset that
+// differs.
+func bisect(
+	ctx context.Context,
+	reference, replica Source,
+	r *api.OffsetRange,
+) (uint64, error) {
+	start, end := r.StartOffset, r.EndOffset
+	for end-start > 1 {
+		mid := start + (end-start)/2
+		same, err := matches(ctx, reference, replica, &api.OffsetRange{
+			StartOffset: start,
+			EndOffset:   mid,
+		})
+		if err != nil {
+			return 0, err
+		}
+		if same {
+			start = mid
+		} else {
+			end = mid
+		}
+	}
+	return start, nil
+}
+
+// matches reports whether both copies have the same checksum for the range.
+func matches(
+	ctx context.Context,
+	reference, replica Source,
+	r *api.OffsetRange,
+) (bool, error) {
+	ranges := []*api.OffsetRange{r}
+	want, err := reference.Checksums(ctx, ranges)
+	if err != nil {
+		return false, err
+	}
+	got, err := replica.Checksums(ctx, ranges)
+	if err != nil {
+		return false, err
+	}
+	if len(want) != 1 || len(got) != 1 {
+		return false, fmt.Errorf(
+			"expected one checksum for offsets %d to %d",
+			r.StartOffset, r.EndOffset,
+		)
+	}
+	return bytes.Equal(want[0].Hash, got[0].Hash), nil
+}
+
+func max(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
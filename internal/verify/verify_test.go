@@ -0,0 +1,80 @@
+package verify
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/Franklynoble/proglog/api/v1"
+	"github.com/Franklynoble/proglog/internal/log"
+)
+
+func TestCompare(t *testing.T) {
+	// the copies roll their segments over at different sizes
+	reference := newLog(t, 64)
+	replica := newLog(t, 256)
+	for i := uint64(0); i < 20; i++ {
+		_, err := reference.Append(&api.Record{
+			Value:      []byte("hello world"),
+			ProducerId: "producer",
+			Sequence:   i + 1,
+		})
+		require.NoError(t, err)
+	}
+	replicate(t, reference, replica, 0, 20)
+	ctx := context.Background()
+
+	result, err := Compare(ctx, Log(reference), Log(replica))
+	require.NoError(t, err)
+	require.False(t, result.Diverged)
+	require.Equal(t, uint64(0), result.Start)
+	require.Equal(t, uint64(20), result.End)
+
+	// the replica lags and then appends a record on its own, which differs
+	// from the reference's record with the same value
+	for _, value := range []string{"first", "second", "third"} {
+		_, err = reference.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	replicate(t, reference, replica, 20, 21)
+	_, err = replica.Append(&api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+
+	result, err = Compare(ctx, Log(reference), Log(replica))
+	require.NoError(t, err)
+	require.Equal(t, Result{
+		ReferenceEnd: 23,
+		ReplicaEnd:   22,
+		Start:        0,
+		End:          22,
+		Diverged:     true,
+		Offset:       21,
+	}, result)
+}
+
+// replicate copies the reference's records from start up to end to the
+// replica, the way a replicator does.
+func replicate(t *testing.T, reference, replica *log.Log, start, end uint64) {
+	t.Helper()
+	for off := start; off < end; off++ {
+		record, err := reference.Read(off)
+		require.NoError(t, err)
+		_, err = replica.Replicate(record)
+		require.NoError(t, err)
+	}
+}
+
+func newLog(t *testing.T, maxStoreBytes uint64) *log.Log {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "verify-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = maxStoreBytes
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	return l
+}